@@ -8,30 +8,62 @@
 package main
 
 import (
-	"github.com/benc-uk/go-rest-api/pkg/api"
+	"context"
+	"net/http"
+	"time"
+
+	restapi "github.com/benc-uk/go-rest-api/pkg/api"
 	"github.com/go-chi/chi/v5"
 )
 
 // ThingAPI is a wrap of the common base API with local implementation
 type ThingAPI struct {
-	*api.Base
+	*restapi.Base
 	// Add extra fields here: database connections, SDK clients
 }
 
 func (api ThingAPI) addPublicRoutes(r chi.Router) {
-	r.Get("/things", api.getThings)
-	r.Get("/things/{id}", api.getThingByID)
-	r.Post("/things", api.createThing)
+	// Typed handlers take a decoded & validated request and return a response or error
+	// These are also added to the OpenAPI document, describe them further with the returned operation
+	// Handlers get a deadline, and a 503 problem is sent if they take longer
+	listRouter := r.With(restapi.Timeout(5*time.Second), thingQuery.Middleware)
+	restapi.Handle(api.Base, listRouter, http.MethodGet, "/things", api.getThings).
+		Describe("List all things", "Supports ?filter=, ?sort= and ?fields=").Tag("things")
+	// Streams aren't cut off by the server's WriteTimeout, each write has 10 seconds instead
+	r.With(restapi.StreamTimeout(10*time.Second)).Get("/things/stream", api.streamThings)
+	api.Document(http.MethodGet, "/things/stream").
+		Describe("Stream all things", "Sent as a JSON array, or NDJSON when requested with Accept").Tag("things").
+		Returns(http.StatusOK, "All things", []ThingResp{}, "application/json", restapi.MediaTypeNDJSON)
+	restapi.Handle(api.Base, r, http.MethodGet, "/things/{id}", api.getThingByID).
+		Describe("Get a thing by ID", "").Tag("things")
+	restapi.Handle(api.Base, r.With(thingIdempotency.Middleware), http.MethodPost, "/things", api.createThing).
+		Describe("Create a new thing", "Send an Idempotency-Key header to retry safely").Tag("things")
 }
 
 func (api ThingAPI) addProtectedRoutes(r chi.Router) {
 	// Put methods here that should be protected & need JWT auth, e.g. POST, PUT, DELETE
-	r.Delete("/things/{id}", api.deleteThing)
+	restapi.Handle(api.Base, r, http.MethodDelete, "/things/{id}", api.deleteThing).
+		Describe("Delete a thing", "").Tag("things").Secure()
 }
 
 func NewThingAPI() ThingAPI {
+	base := restapi.NewBase(serviceName, version, buildInfo, healthy)
+
+	// Register health checks for things the service depends on, e.g. databases, downstream APIs
+	base.AddHealthCheck(restapi.HealthCheck{
+		Name:     "example",
+		Probes:   restapi.ReadinessProbe | restapi.StartupProbe,
+		Timeout:  2 * time.Second,
+		Critical: true,
+		CacheTTL: 5 * time.Second,
+		Check: func(ctx context.Context) error {
+			// Put some better logic here with a real API, e.g. ping the database
+			return nil
+		},
+	})
+
 	return ThingAPI{
-		api.NewBase(serviceName, version, buildInfo, healthy),
+		base,
 		// Database connections, SDK clients, etc can be added here
 	}
 }
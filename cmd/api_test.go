@@ -8,15 +8,48 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
 
 	"github.com/benc-uk/go-rest-api/pkg/api"
 	"github.com/benc-uk/go-rest-api/pkg/auth"
+	"github.com/benc-uk/go-rest-api/pkg/dapr/pubsub"
 	"github.com/benc-uk/go-rest-api/pkg/httptester"
+	"github.com/benc-uk/go-rest-api/pkg/openapi"
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+	"github.com/benc-uk/go-rest-api/pkg/requestid"
+	"github.com/benc-uk/go-rest-api/pkg/sse"
+	"github.com/benc-uk/go-rest-api/pkg/trace"
 )
 
 func TestUsers(t *testing.T) {
@@ -24,13 +57,41 @@ func TestUsers(t *testing.T) {
 	log.SetOutput(io.Discard)
 
 	router := chi.NewRouter()
+	base := api.NewBase("thing", "ignore", "ignore", true)
+
+	base.AddHealthCheck(api.HealthCheck{
+		Name:     "database",
+		Critical: true,
+		Check:    func(ctx context.Context) error { return nil },
+	})
+	base.AddHealthCheck(api.HealthCheck{
+		Name:   "downstream",
+		Probes: api.ReadinessProbe | api.LivenessProbe,
+		Check:  func(ctx context.Context) error { return errors.New("downstream unavailable") },
+	})
+	base.AddHealthCheck(api.HealthCheck{
+		Name:     "broken",
+		Probes:   api.StartupProbe,
+		Critical: true,
+		Check:    func(ctx context.Context) error { return errors.New("still starting") },
+	})
+
 	api := ThingAPI{
-		api.NewBase("thing", "ignore", "ignore", true),
+		base,
 		// inject mocks here
 	}
 
+	// Problems for panics, unknown routes & methods
+	router.Use(api.RecoverMiddleware)
+	api.AddProblemHandlers(router)
+	router.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("something went very wrong")
+	})
+
 	// Add optional endpoints
 	api.AddOKEndpoint(router, "")
+	api.AddProbeEndpoints(router)
+	api.AddOpenAPIEndpoint(router, "openapi")
 
 	// Test the protected routes and JWT validation
 	router.Group(func(protectedRouter chi.Router) {
@@ -42,6 +103,608 @@ func TestUsers(t *testing.T) {
 	api.addPublicRoutes(router)
 
 	httptester.Run(t, router, testCases)
+
+	// A recorder doesn't show headers set after the status is written, so check the probes on a real server
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/startupz?verbose")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Failing verbose probe: got %d %s, wanted 503 application/json",
+			resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestRecoverHijacked(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	router := chi.NewRouter()
+	api := NewThingAPI()
+	router.Use(api.RecoverMiddleware)
+
+	router.Get("/hijack", func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("Hijack failed: %s", err)
+			return
+		}
+
+		defer conn.Close()
+
+		panic("oh no")
+	})
+
+	// Real server, writing to a hijacked connection is logged
+	serverLog := &bytes.Buffer{}
+	srv := httptest.NewUnstartedServer(router)
+	srv.Config.ErrorLog = log.New(serverLog, "", 0)
+	srv.Start()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = conn.Write([]byte("GET /hijack HTTP/1.1\r\nHost: test\r\n\r\n"))
+	body, _ := io.ReadAll(conn)
+	conn.Close()
+	srv.Close()
+
+	if len(body) > 0 || strings.Contains(serverLog.String(), "hijacked") {
+		t.Errorf("Got %q and log %q, wanted nothing sent on the hijacked connection", body, serverLog.String())
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	healthy := api.Healthy
+
+	api := ThingAPI{
+		api.NewBase("thing", "ignore", "ignore", true),
+	}
+
+	calls := []string{}
+	api.OnStart(func(ctx context.Context) error {
+		calls = append(calls, "start")
+		return nil
+	})
+	api.OnStop(func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok || ctx.Err() != nil {
+			t.Errorf("Stop hook should get a live context with a deadline, err: %v", ctx.Err())
+		}
+
+		calls = append(calls, "stop1")
+		return nil
+	})
+	api.OnStop(func(ctx context.Context) error {
+		calls = append(calls, "stop2")
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := api.StartServerContext(ctx, 0, chi.NewRouter(), time.Second); err != nil {
+		t.Fatalf("StartServerContext returned error: %s", err)
+	}
+
+	if len(calls) != 3 || calls[0] != "start" || calls[1] != "stop1" || calls[2] != "stop2" {
+		t.Errorf("Hooks not run in order, got %v", calls)
+	}
+
+	if api.Health().Level.String() != "unhealthy" {
+		t.Errorf("Service should be marked unhealthy after shutdown")
+	}
+
+	api.SetHealth(healthy, "")
+
+	if api.Health().Level.String() != "unhealthy" {
+		t.Errorf("Service health should stay pinned as unhealthy after shutdown")
+	}
+}
+
+func TestTLS(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	dir := t.TempDir()
+	ca, caKey := newTestCert(t, "Test CA", nil, nil)
+	server, serverKey := newTestCert(t, "server one", ca, caKey)
+	client, clientKey := newTestCert(t, "client", ca, caKey)
+
+	writeTestPEM(t, dir+"/ca.pem", ca, nil)
+	writeTestPEM(t, dir+"/server.pem", server, serverKey)
+	writeTestPEM(t, dir+"/client.pem", client, clientKey)
+
+	base := api.NewBase("thing", "ignore", "ignore", true)
+	router := chi.NewRouter()
+	router.Get("/hello", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello " + r.TLS.PeerCertificates[0].Subject.CommonName))
+	})
+
+	port := freePort(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- base.StartServerTLSContext(ctx, port, router, time.Second, api.TLSOptions{
+			CertFile:       dir + "/server.pem",
+			KeyFile:        dir + "/server.pem",
+			ClientCAFile:   dir + "/ca.pem",
+			ReloadInterval: 20 * time.Millisecond,
+		})
+	}()
+
+	defer func() {
+		cancel()
+
+		if err := <-done; err != nil {
+			t.Errorf("StartServerTLSContext returned error: %s", err)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	clientCert := tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	// Handshakes, returning the common name of the server's certificate
+	dial := func(certs []tls.Certificate) (string, error) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, Certificates: certs, ServerName: "localhost"})
+		if err != nil {
+			return "", err
+		}
+
+		defer conn.Close()
+
+		// With TLS 1.3 a missing client certificate is only reported on the first read
+		if _, err := conn.Write([]byte("GET /hello HTTP/1.0\r\n\r\n")); err != nil {
+			return "", err
+		}
+
+		body, err := io.ReadAll(conn)
+		if err != nil {
+			return "", err
+		}
+
+		if !bytes.Contains(body, []byte("hello client")) {
+			return "", fmt.Errorf("unexpected response %q", body)
+		}
+
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	// Wait for the server to start listening
+	var name string
+
+	var err error
+
+	for i := 0; i < 50; i++ {
+		if name, err = dial([]tls.Certificate{clientCert}); err == nil {
+			break
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err != nil || name != "server one" {
+		t.Fatalf("Handshake with client certificate: got %q %v", name, err)
+	}
+
+	if _, err := dial(nil); err == nil || strings.Contains(err.Error(), "unexpected response") {
+		t.Errorf("Client without a certificate was not rejected in the handshake, got %v", err)
+	}
+
+	if status := base.TLSStatus(); status == nil || !status.MutualTLS || status.Subject != "CN=server one" {
+		t.Errorf("Unexpected TLS status %+v", status)
+	}
+
+	// Rotate the certificate, it should be picked up without a restart
+	rotated, rotatedKey := newTestCert(t, "server two", ca, caKey)
+	writeTestPEM(t, dir+"/server.pem", rotated, rotatedKey)
+
+	later := time.Now().Add(time.Second)
+	_ = os.Chtimes(dir+"/server.pem", later, later)
+
+	for i := 0; i < 50; i++ {
+		if name, err = dial([]tls.Certificate{clientCert}); err == nil && name == "server two" {
+			break
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if name != "server two" {
+		t.Errorf("Rotated certificate was not picked up, got %q %v", name, err)
+	}
+}
+
+func TestAdminServer(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	base := api.NewBase("thing", "ignore", "ignore", true)
+	port, adminPort := freePort(t), freePort(t)
+
+	router := chi.NewRouter()
+	router.Get("/things", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("things"))
+	})
+
+	admin := base.EnableAdminServer(adminPort)
+	base.AddHealthEndpoint(admin, "health", nil)
+	base.AddStatusEndpoint(admin, "status")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- base.StartServerContext(ctx, port, router, time.Second)
+	}()
+
+	defer func() {
+		cancel()
+
+		if err := <-done; err != nil {
+			t.Errorf("StartServerContext returned error: %s", err)
+		}
+	}()
+
+	get := func(port int, path string) int {
+		for i := 0; i < 50; i++ {
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, path))
+			if err != nil {
+				// Not listening yet
+				time.Sleep(20 * time.Millisecond)
+				continue
+			}
+
+			resp.Body.Close()
+
+			return resp.StatusCode
+		}
+
+		return 0
+	}
+
+	for _, c := range []struct {
+		port   int
+		path   string
+		status int
+	}{
+		{adminPort, "/health", http.StatusOK},
+		{adminPort, "/status", http.StatusOK},
+		{adminPort, "/things", http.StatusNotFound},
+		{port, "/things", http.StatusOK},
+		{port, "/health", http.StatusNotFound},
+		{port, "/status", http.StatusNotFound},
+	} {
+		if status := get(c.port, c.path); status != c.status {
+			t.Errorf("GET %s on port %d: got %d, wanted %d", c.path, c.port, status, c.status)
+		}
+	}
+}
+
+func TestHealthState(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	base := api.NewBase("thing", "ignore", "ignore", true)
+
+	changes := 0
+	base.OnHealthChange(func(prev, curr api.HealthState) {
+		changes++
+
+		if prev.Level != api.Healthy || curr.Level != api.Degraded || curr.Reason != "cache offline" {
+			t.Errorf("Unexpected transition from %v to %v", prev, curr)
+		}
+	})
+
+	base.SetHealth(api.Degraded, "cache offline")
+	base.SetHealth(api.Degraded, "cache offline")
+
+	if changes != 1 {
+		t.Errorf("Expected 1 change notification, got %d", changes)
+	}
+
+	router := chi.NewRouter()
+	base.AddHealthEndpoint(router, "health", nil)
+	base.AddStatusEndpoint(router, "status")
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:           "degraded health",
+			URL:            "/health",
+			Method:         "GET",
+			CheckBody:      `degraded \(cache offline\)`,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+		{
+			Name:           "degraded status",
+			URL:            "/status",
+			Method:         "GET",
+			CheckBody:      `"level":"degraded","reason":"cache offline"`,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+	})
+}
+
+func TestValidateTags(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	type badPattern struct {
+		Code string `json:"code" validate:"regex=[a-z"`
+	}
+
+	type badNested struct {
+		Items []struct {
+			Size int `json:"size" validate:"min=one"`
+		} `json:"items"`
+	}
+
+	if err := api.CheckValidateTags(badPattern{}); err == nil || !strings.Contains(err.Error(), "field Code") {
+		t.Errorf("Bad regex: got %v, wanted an error", err)
+	}
+
+	if err := api.CheckValidateTags(badNested{}); err == nil || !strings.Contains(err.Error(), "invalid min rule") {
+		t.Errorf("Bad nested rule: got %v, wanted an error", err)
+	}
+
+	if err := api.CheckValidateTags(CreateThing{}); err != nil {
+		t.Errorf("Valid tags: got %v", err)
+	}
+
+	// Binding a bad type is a server error, not a panic
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"code":"abc"}`))
+	if _, prob := api.Bind[badPattern](req); prob == nil || prob.Status != http.StatusInternalServerError {
+		t.Errorf("Bind with bad tags: got %v, wanted a 500 problem", prob)
+	}
+
+	// Registering a handler with bad tags fails at startup
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Handle with bad tags did not panic")
+		}
+	}()
+
+	api.Handle(api.NewBase("thing", "ignore", "ignore", true), chi.NewRouter(), http.MethodPost, "/bad",
+		func(ctx context.Context, in badPattern) (api.NoContent, error) {
+			return api.NoContent{}, nil
+		})
+}
+
+func TestBindBody(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	type updateThing struct {
+		ID    string `path:"id"`
+		Force bool   `query:"force"`
+		Name  string `json:"name"`
+	}
+
+	bind := func(body string, opts api.BindOptions) (updateThing, *problem.Problem) {
+		req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		return api.BindWith[updateThing](req, opts)
+	}
+
+	if _, prob := bind(`{"ID":"2","name":"Toast"}`, api.DefaultBindOptions); prob == nil ||
+		prob.InvalidParams[0].Reason != "unknown field" {
+		t.Errorf("Path field in body: got %v, wanted an unknown field problem", prob)
+	}
+
+	lax := api.BindOptions{AllowUnknownFields: true}
+	if in, prob := bind(`{"ID":"2","Force":true,"name":"Toast"}`, lax); prob != nil || in.ID != "" || in.Force {
+		t.Errorf("Param fields in body: got %+v %v, wanted them left unset", in, prob)
+	}
+
+	if _, prob := bind(`{"name":"Toast"} {"name":"Beans"}`, api.DefaultBindOptions); prob == nil ||
+		prob.Detail != "body must contain a single JSON value" {
+		t.Errorf("Trailing data: got %v, wanted a problem", prob)
+	}
+
+	if in, prob := bind("{\"name\":\"Toast\"}\n", api.DefaultBindOptions); prob != nil || in.Name != "Toast" {
+		t.Errorf("Trailing whitespace: got %+v %v, wanted it decoded", in, prob)
+	}
+}
+
+func TestPageTotals(t *testing.T) {
+	paginator := api.NewPaginator([]byte("secret"))
+
+	page, prob := paginator.Parse(httptest.NewRequest(http.MethodGet, "/things?limit=2", nil))
+	if prob != nil {
+		t.Fatalf("Parse failed: %v", prob)
+	}
+
+	// The zero value means the total isn't known, rather than zero items
+	env := api.NewPageEnvelope(paginator, []string{"a", "b"}, page, api.PageInfo{HasMore: true})
+	body, _ := json.Marshal(env)
+
+	if env.Total != nil || strings.Contains(string(body), `"total"`) || env.Links.Next == "" {
+		t.Errorf("Unknown total: got %s, wanted no total and a next link", body)
+	}
+
+	total := 2
+	env = api.NewPageEnvelope(paginator, []string{"a", "b"}, page, api.PageInfo{Total: &total})
+
+	if env.Total == nil || *env.Total != 2 || env.Links.Next != "" {
+		t.Errorf("Known total: got %+v, wanted a total of 2 and no next link", env)
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	base := api.NewBase("thing", "ignore", "ignore", true)
+	router := chi.NewRouter()
+
+	failWith := func(err error) http.HandlerFunc {
+		return api.Adapt(base, func(ctx context.Context, in struct{}) (api.NoContent, error) {
+			return api.NoContent{}, err
+		})
+	}
+
+	router.Get("/internal", failWith(errors.New("dial tcp 10.1.2.3:5432: password authentication failed")))
+	router.Get("/both", failWith(errors.Join(api.ErrConflict, api.ErrNotFound)))
+	router.Get("/no-status", failWith(&problem.Problem{Type: "custom", Detail: "no status set"}))
+
+	// A sentinel problem returned by every request, it must not keep the details of earlier ones
+	shared := &problem.Problem{Type: "shared", Status: http.StatusConflict}
+	router.Get("/shared/{n}", failWith(shared))
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:           "internal error detail is not sent",
+			URL:            "/internal",
+			Method:         "GET",
+			CheckBody:      `"detail":"an unexpected error occurred handling the request"`,
+			CheckBodyCount: 1,
+			CheckStatus:    500,
+		},
+		{
+			Name:           "first matching sentinel wins",
+			URL:            "/both",
+			Method:         "GET",
+			CheckBody:      `"type":"not-found"`,
+			CheckBodyCount: 1,
+			CheckStatus:    404,
+		},
+		{
+			Name:           "problem without status",
+			URL:            "/no-status",
+			Method:         "GET",
+			CheckBody:      `"type":"custom","title":"Internal Server Error","status":500`,
+			CheckBodyCount: 1,
+			CheckStatus:    500,
+		},
+		{
+			Name:           "shared problem first use",
+			URL:            "/shared/1",
+			Method:         "GET",
+			CheckBody:      `"instance":"/shared/1"`,
+			CheckBodyCount: 1,
+			CheckStatus:    409,
+		},
+		{
+			Name:           "shared problem second use",
+			URL:            "/shared/2",
+			Method:         "GET",
+			CheckBody:      `"instance":"/shared/2"`,
+			CheckBodyCount: 1,
+			CheckStatus:    409,
+		},
+	})
+
+	if shared.Title != "" || shared.Instance != "" {
+		t.Errorf("Shared problem was changed: %+v", shared)
+	}
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	// Same name as problem.Problem, from a different package
+	type Problem struct {
+		Code int `json:"code"`
+	}
+
+	type Audit struct {
+		Created string `json:"created"`
+		Name    string `json:"name"`
+	}
+
+	type Doc struct {
+		Audit
+		Name  string `json:"name" validate:"required"`
+		Owner struct {
+			Email string `json:"email"`
+		} `json:"owner"`
+	}
+
+	base := api.NewBase("thing", "ignore", "ignore", true)
+	base.Document(http.MethodGet, "/problem").Returns(http.StatusOK, "", Problem{})
+	base.Document(http.MethodGet, "/doc").Returns(http.StatusOK, "", Doc{})
+	base.Document(http.MethodGet, "/anon").Returns(http.StatusOK, "", struct {
+		Size int `json:"size"`
+	}{})
+
+	spec, _ := json.Marshal(base.OpenAPISpec())
+	doc := string(spec)
+
+	for _, want := range []string{
+		// Both problems are kept, the package's own keeps its name
+		`"Problem":{"properties":{"detail"`,
+		`"cmd.Problem":{"properties":{"code"`,
+		// Embedded fields are promoted, the outer name field wins, and anonymous structs are inlined
+		`"Doc":{"properties":{"created":{"type":"string"},"name":{"type":"string"},` +
+			`"owner":{"properties":{"email":{"type":"string"}},"type":"object"}},"required":["name"]`,
+		`"schema":{"properties":{"size":{"type":"integer"}},"type":"object"}`,
+	} {
+		if !strings.Contains(doc, want) {
+			t.Errorf("OpenAPI document is missing %s", want)
+		}
+	}
+
+	if strings.Contains(doc, "Anonymous") || strings.Contains(doc, `"Audit"`) {
+		t.Errorf("OpenAPI document has components for anonymous or embedded structs")
+	}
+}
+
+func TestOpenAPIValidation(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	api := NewThingAPI()
+
+	// Use the generated document to validate both requests & responses
+	api.addPublicRoutes(chi.NewRouter())
+
+	spec, _ := json.Marshal(api.OpenAPISpec())
+
+	validator, err := openapi.NewValidator(spec, openapi.Options{
+		ValidateResponses:     true,
+		FailOnInvalidResponse: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create validator: %s", err)
+	}
+
+	router := chi.NewRouter()
+	router.Use(validator.Middleware)
+	api.addPublicRoutes(router)
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:           "valid request & response",
+			URL:            "/things",
+			Method:         "GET",
+			CheckBody:      "Cheese",
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+		{
+			Name:           "invalid body",
+			URL:            "/things",
+			Method:         "POST",
+			Body:           `{"name":"C","tags":[1]}`,
+			CheckBody:      `{"name":"body.name","reason":"minimum string length is 2"}|"name":"body.tags.0"`,
+			CheckBodyCount: 2,
+			CheckStatus:    400,
+		},
+		{
+			Name:        "unknown route passed through",
+			URL:         "/goats",
+			Method:      "GET",
+			CheckStatus: 404,
+		},
+	})
 }
 
 var testCases = []httptester.TestCase{
@@ -64,39 +727,1940 @@ var testCases = []httptester.TestCase{
 		CheckStatus:    200,
 	},
 	{
-		Name:           "post things API",
-		URL:            "/things",
-		Method:         "POST",
-		Body:           `{"name":"Cheese"}`,
-		CheckBody:      `{"result":"ok"}`,
+		Name:   "get things paged",
+		URL:    "/things?limit=2&offset=2",
+		Method: "GET",
+		CheckBody: `"items":\[{"name":"Beans On Toast"},{"name":"Fish Finger Sandwich"}\],` +
+			`"total":5,"limit":2,"offset":2`,
 		CheckBodyCount: 1,
 		CheckStatus:    200,
 	},
 	{
-		Name:           "invalid method",
-		URL:            "/things",
-		Method:         "PUT",
-		Body:           ``,
-		CheckBody:      ``,
-		CheckBodyCount: 0,
-		CheckStatus:    405,
+		Name:           "get things offset overflow",
+		URL:            "/things?limit=5&offset=9223372036854775805",
+		Method:         "GET",
+		CheckBody:      `{"name":"offset","reason":"must be no more than 9223372036854775802"}`,
+		CheckBodyCount: 1,
+		CheckStatus:    400,
 	},
 	{
-		Name:           "invalid URL",
-		URL:            "/goats",
+		Name:           "get things bad limit",
+		URL:            "/things?limit=-1",
 		Method:         "GET",
-		Body:           ``,
-		CheckBody:      ``,
-		CheckBodyCount: 0,
-		CheckStatus:    404,
+		CheckBody:      `{"name":"limit","reason":"must be a positive integer"}`,
+		CheckBodyCount: 1,
+		CheckStatus:    400,
 	},
 	{
-		Name:           "delete thing",
-		URL:            "/things/1",
-		Method:         "DELETE",
-		Body:           ``,
-		CheckBody:      ``,
-		CheckBodyCount: 0,
-		CheckStatus:    401,
+		Name:           "get things tampered cursor",
+		URL:            "/things?cursor=eyJvIjoyfQ.AAAA",
+		Method:         "GET",
+		CheckBody:      `{"name":"cursor","reason":"is invalid or has been tampered with"}`,
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "get things filtered & sorted",
+		URL:            "/things?filter=name%20contains%20%27toast%27&sort=-name&fields=name",
+		Method:         "GET",
+		CheckBody:      `"items":\[{"name":"Cheese On Toast"},{"name":"Beans On Toast"}\],"total":2`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get things filter with or & not",
+		URL:            "/things?filter=not%20(name%20startswith%20%27b%27%20or%20name%20eq%20%27Crumpets%27)",
+		Method:         "GET",
+		CheckBody:      `"total":2`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get things unknown filter field",
+		URL:            "/things?filter=colour%20eq%20%27red%27",
+		Method:         "GET",
+		CheckBody:      `can not filter by 'colour', allowed fields are: name`,
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "get things bad operator",
+		URL:            "/things?filter=name%20like%20%27x%27",
+		Method:         "GET",
+		CheckBody:      `operator 'like' at position 5 is not valid for field 'name'`,
+		CheckBodyCount: 1,
+		CheckStatus:    400,
 	},
+	{
+		Name:           "get things filter too deep",
+		URL:            "/things?filter=" + strings.Repeat("%28", 30) + "name%20eq%20%27x%27" + strings.Repeat("%29", 30),
+		Method:         "GET",
+		CheckBody:      `is nested more than 20 levels deep`,
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "get things unknown sort & fields",
+		URL:            "/things?sort=created&fields=id",
+		Method:         "GET",
+		CheckBody:      `"name":"(sort|fields)"`,
+		CheckBodyCount: 2,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "stream things as NDJSON",
+		URL:            "/things/stream",
+		Method:         "GET",
+		Headers:        map[string]string{"Accept": "application/x-ndjson"},
+		CheckBody:      `(?m)^{"name":"[^"]+"}$`,
+		CheckBodyCount: 5,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get things as CSV",
+		URL:            "/things",
+		Method:         "GET",
+		Headers:        map[string]string{"Accept": "text/csv"},
+		CheckBody:      "^name\nCheese On Toast\nBacon Sandwich\nBeans On Toast\nFish Finger Sandwich\nCrumpets\n$",
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get things as XML",
+		URL:            "/things",
+		Method:         "GET",
+		Headers:        map[string]string{"Accept": "application/xml;q=0.9, application/json;q=0.5"},
+		CheckBody:      "<items><ThingResp><Name>Cheese On Toast</Name></ThingResp>",
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get thing as CSV",
+		URL:            "/things/1",
+		Method:         "GET",
+		Headers:        map[string]string{"Accept": "text/csv"},
+		CheckBody:      "^name\nCheese On Toast\n$",
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get thing as XML",
+		URL:            "/things/1",
+		Method:         "GET",
+		Headers:        map[string]string{"Accept": "application/xml;q=0.9, application/json;q=0.5"},
+		CheckBody:      "<ThingResp><Name>Cheese On Toast</Name></ThingResp>",
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get thing as YAML",
+		URL:            "/things/1",
+		Method:         "GET",
+		Headers:        map[string]string{"Accept": "application/yaml"},
+		CheckBody:      "name: Cheese On Toast",
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get things not acceptable",
+		URL:            "/things",
+		Method:         "GET",
+		Headers:        map[string]string{"Accept": "image/png"},
+		CheckBody:      "not-acceptable",
+		CheckBodyCount: 1,
+		CheckStatus:    406,
+	},
+	{
+		Name:           "post things API",
+		URL:            "/things",
+		Method:         "POST",
+		Body:           `{"name":"Cheese"}`,
+		CheckBody:      `{"name":"Cheese"}`,
+		CheckBodyCount: 1,
+		CheckStatus:    201,
+	},
+	{
+		Name:   "post things invalid",
+		URL:    "/things",
+		Method: "POST",
+		Body:   `{"name":"C","owner":"not-an-email"}`,
+		CheckBody: `{"name":"name","reason":"must be at least 2 characters"},` +
+			`{"name":"owner","reason":"must be a valid email address"}`,
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "post things unknown field",
+		URL:            "/things",
+		Method:         "POST",
+		Body:           `{"name":"Cheese","colour":"blue"}`,
+		CheckBody:      `unknown field`,
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "post things as form",
+		URL:            "/things",
+		Method:         "POST",
+		Body:           `name=Cheese&tags=a&tags=b`,
+		Headers:        map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+		CheckBody:      `{"name":"Cheese"}`,
+		CheckBodyCount: 1,
+		CheckStatus:    201,
+	},
+	{
+		Name:           "get thing not found",
+		URL:            "/things/99",
+		Method:         "GET",
+		CheckBody:      `"type":"not-found","title":"Not Found","status":404,"detail":"thing 99: not found"`,
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
+	{
+		Name:           "openapi document",
+		URL:            "/openapi",
+		Method:         "GET",
+		CheckBody:      `"openapi":"3.1.0"|"/things/\{id\}":\{"delete"|"security":\[\{"jwt":\[\]\}\]|"required":\["name"\]`,
+		CheckBodyCount: 4,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "openapi docs page",
+		URL:            "/openapi/docs",
+		Method:         "GET",
+		CheckBody:      `const specURL = '/openapi'`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "invalid method",
+		URL:            "/things",
+		Method:         "PUT",
+		Body:           ``,
+		CheckBody:      `"status":405,"detail":"method PUT is not allowed, use one of: GET, POST"`,
+		CheckBodyCount: 1,
+		CheckStatus:    405,
+		CheckHeaders:   map[string]string{"Allow": "^GET, POST$"},
+	},
+	{
+		Name:           "invalid method on protected route",
+		URL:            "/things/1",
+		Method:         "POST",
+		CheckBody:      `"status":405`,
+		CheckBodyCount: 1,
+		CheckStatus:    405,
+		CheckHeaders:   map[string]string{"Allow": "^GET, DELETE$"},
+	},
+	{
+		Name:           "invalid URL",
+		URL:            "/goats",
+		Method:         "GET",
+		Body:           ``,
+		CheckBody:      `"type":"not-found",.*"detail":"no route matches '/goats'"`,
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
+	{
+		Name:           "panic recovered",
+		URL:            "/panic",
+		Method:         "GET",
+		CheckBody:      `"type":"internal-server-error",.*"status":500`,
+		CheckBodyCount: 1,
+		CheckStatus:    500,
+	},
+	{
+		Name:           "panic with an upgrade header is still a problem",
+		URL:            "/panic",
+		Method:         "GET",
+		Headers:        map[string]string{"Connection": "keep-alive, upgrade"},
+		CheckBody:      `"type":"internal-server-error"`,
+		CheckBodyCount: 1,
+		CheckStatus:    500,
+	},
+	{
+		Name:           "readiness probe",
+		URL:            "/readyz",
+		Method:         "GET",
+		Body:           ``,
+		CheckBody:      "OK",
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "readiness probe verbose",
+		URL:            "/readyz?verbose",
+		Method:         "GET",
+		Body:           ``,
+		CheckBody:      `"healthy":false,"critical":false,"error":"downstream unavailable"`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "liveness probe",
+		URL:            "/livez",
+		Method:         "GET",
+		Body:           ``,
+		CheckBody:      "OK",
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "startup probe failing",
+		URL:            "/startupz",
+		Method:         "GET",
+		Body:           ``,
+		CheckBody:      "FAIL",
+		CheckBodyCount: 1,
+		CheckStatus:    503,
+	},
+	{
+		Name:           "delete thing",
+		URL:            "/things/1",
+		Method:         "DELETE",
+		Body:           ``,
+		CheckBody:      ``,
+		CheckBodyCount: 0,
+		CheckStatus:    401,
+	},
+}
+
+func TestOpenAPIValidatorLoaders(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	spec := `openapi: 3.0.3
+info: {title: things, version: "1"}
+paths:
+  /things:
+    post:
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema: {$ref: "../common.yaml#/components/schemas/Thing"}
+      responses:
+        "201": {description: created}
+`
+	common := `components:
+  schemas:
+    Thing: {type: object, required: [name], properties: {name: {type: string}}}
+`
+
+	dir := t.TempDir()
+	_ = os.Mkdir(dir+"/specs", 0o700)
+	_ = os.WriteFile(dir+"/specs/api.yaml", []byte(spec), 0o600)
+	_ = os.WriteFile(dir+"/common.yaml", []byte(common), 0o600)
+
+	cwd, _ := os.Getwd()
+	relative, _ := filepath.Rel(cwd, dir+"/specs/api.yaml")
+
+	// Works the same as an embed.FS
+	mapFS := fstest.MapFS{
+		"specs/api.yaml": {Data: []byte(spec)},
+		"common.yaml":    {Data: []byte(common)},
+	}
+
+	loaders := map[string]func() (*openapi.Validator, error){
+		"absolute file": func() (*openapi.Validator, error) {
+			return openapi.NewValidatorFromFile(dir+"/specs/api.yaml", openapi.Options{})
+		},
+		"relative file": func() (*openapi.Validator, error) {
+			return openapi.NewValidatorFromFile(relative, openapi.Options{})
+		},
+		"filesystem": func() (*openapi.Validator, error) {
+			return openapi.NewValidatorFromFS(mapFS, "specs/api.yaml", openapi.Options{})
+		},
+	}
+
+	for name, load := range loaders {
+		validator, err := load()
+		if err != nil {
+			t.Errorf("%s: failed to load: %s", name, err)
+			continue
+		}
+
+		router := chi.NewRouter()
+		router.Use(validator.Middleware)
+		router.Post("/things", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+		})
+
+		for body, status := range map[string]int{`{"name":"toast"}`: 201, `{"size":1}`: 400} {
+			req := httptest.NewRequest(http.MethodPost, "/things", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != status {
+				t.Errorf("%s: POST %s got %d, wanted %d", name, body, rec.Code, status)
+			}
+		}
+	}
+}
+
+func TestOpenAPIValidatorServers(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	// Requests are sent to httptest's host, not the servers in the document
+	spec := `openapi: 3.0.3
+info: {title: things, version: "1"}
+servers:
+  - url: https://api.example.com/v1
+  - url: "{scheme}://{host}/v2"
+    variables:
+      scheme: {default: https}
+      host: {default: api.example.com}
+paths:
+  /things:
+    post:
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema: {type: object, required: [name], properties: {name: {type: string}}}
+      responses:
+        "201": {description: created}
+`
+
+	validator, err := openapi.NewValidator([]byte(spec), openapi.Options{})
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+
+	router := chi.NewRouter()
+	router.Use(validator.Middleware)
+	router.Post("/{version}/things", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	for _, url := range []string{"http://localhost:8000/v1/things", "http://10.0.0.1/v2/things"} {
+		req := httptest.NewRequest(http.MethodPost, url, strings.NewReader(`{"size":1}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("POST %s got %d, wanted 400 as the body is invalid", url, rec.Code)
+		}
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	etag := api.ETag([]byte(`{"name":"Cheese On Toast"}`))
+
+	// Something with a version that must be matched before it's changed
+	version := `"v2"`
+	router := chi.NewRouter()
+	router.With(api.RequirePreconditions(func(r *http.Request) (string, time.Time, error) {
+		return version, time.Time{}, nil
+	}, true)).Put("/versioned", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// ReturnJSON tags responses, ETagMiddleware tags anything else and answers If-None-Match
+	base := api.NewBase("thing", "ignore", "ignore", true)
+	etagged := router.With(api.ETagMiddleware(true))
+	etagged.Get("/json", func(w http.ResponseWriter, r *http.Request) {
+		base.ReturnJSON(w, map[string]string{"name": "Cheese On Toast"})
+	})
+	etagged.Get("/text", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+	etagged.Get("/flushed", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("streamed"))
+		w.(http.Flusher).Flush()
+	})
+
+	textTag := api.WeakETag([]byte("hello"))
+
+	// No auth here, so the protected routes can be called directly
+	api := NewThingAPI()
+	api.addPublicRoutes(router)
+	api.addProtectedRoutes(router)
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:        "not modified",
+			URL:         "/things/1",
+			Method:      "GET",
+			Headers:     map[string]string{"If-None-Match": "W/" + etag},
+			CheckStatus: 304,
+		},
+		{
+			Name:           "modified",
+			URL:            "/things/1",
+			Method:         "GET",
+			Headers:        map[string]string{"If-None-Match": `"stale"`},
+			CheckBody:      "Cheese",
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+		{
+			Name:           "ReturnJSON sets an ETag",
+			URL:            "/json",
+			Method:         "GET",
+			CheckHeaders:   map[string]string{"ETag": "^" + regexp.QuoteMeta(etag) + "$"},
+			CheckBody:      "Cheese",
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+		{
+			Name:        "ReturnJSON not modified",
+			URL:         "/json",
+			Method:      "GET",
+			Headers:     map[string]string{"If-None-Match": etag},
+			CheckStatus: 304,
+		},
+		{
+			Name:           "middleware hashes the body",
+			URL:            "/text",
+			Method:         "GET",
+			CheckHeaders:   map[string]string{"ETag": "^" + regexp.QuoteMeta(textTag) + "$"},
+			CheckBody:      "^hello$",
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+		{
+			Name:        "middleware not modified",
+			URL:         "/text",
+			Method:      "GET",
+			Headers:     map[string]string{"If-None-Match": textTag},
+			CheckStatus: 304,
+		},
+		{
+			Name:           "flushed responses are not tagged",
+			URL:            "/flushed",
+			Method:         "GET",
+			Headers:        map[string]string{"If-None-Match": "*"},
+			CheckHeaders:   map[string]string{"ETag": "^$"},
+			CheckBody:      "^streamed$",
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+		{
+			Name:           "delete with stale If-Match",
+			URL:            "/things/1",
+			Method:         "DELETE",
+			Headers:        map[string]string{"If-Match": `"stale"`},
+			CheckBody:      `"status":412`,
+			CheckBodyCount: 1,
+			CheckStatus:    412,
+		},
+		{
+			Name:        "delete with current If-Match",
+			URL:         "/things/1",
+			Method:      "DELETE",
+			Headers:     map[string]string{"If-Match": etag},
+			CheckStatus: 204,
+		},
+		{
+			Name:           "precondition required",
+			URL:            "/versioned",
+			Method:         "PUT",
+			CheckBody:      `"status":428`,
+			CheckBodyCount: 1,
+			CheckStatus:    428,
+		},
+		{
+			Name:        "weak tags never match If-Match",
+			URL:         "/versioned",
+			Method:      "PUT",
+			Headers:     map[string]string{"If-Match": "W/" + version},
+			CheckStatus: 412,
+		},
+		{
+			Name:        "matching If-Match",
+			URL:         "/versioned",
+			Method:      "PUT",
+			Headers:     map[string]string{"If-Match": version},
+			CheckStatus: 204,
+		},
+	})
+}
+
+func TestStreaming(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	router := chi.NewRouter()
+
+	// Fails part way through, after the status has been sent
+	router.Get("/failing", func(w http.ResponseWriter, r *http.Request) {
+		_ = api.Stream(w, r, func(yield func(int, error) bool) {
+			_ = yield(1, nil) && yield(2, nil) && yield(0, errors.New("database went away"))
+		})
+	})
+
+	router.Get("/chan", func(w http.ResponseWriter, r *http.Request) {
+		items := make(chan string)
+
+		go func() {
+			defer close(items)
+
+			for _, item := range []string{"a", "b", "c"} {
+				items <- item
+			}
+		}()
+
+		_ = api.Stream(w, r, api.FromChan(r.Context(), items, nil))
+	})
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:           "error as trailing array item",
+			URL:            "/failing",
+			Method:         "GET",
+			CheckBody:      `^\[1,2,{"error":{"type":"stream-error",.*"detail":"an unexpected error.*".*}}\]$`,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+		{
+			Name:           "error as trailing NDJSON record",
+			URL:            "/failing",
+			Method:         "GET",
+			Headers:        map[string]string{"Accept": "application/x-ndjson"},
+			CheckBody:      `^1\n2\n{"error":{"type":"stream-error"`,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+		{
+			Name:           "stream from channel",
+			URL:            "/chan",
+			Method:         "GET",
+			CheckBody:      `^\["a","b","c"\]$`,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+	})
+}
+
+func TestCompression(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	compress := api.CompressMiddleware(api.DefaultCompressOptions)
+	broker := sse.NewBroker[string]()
+	connected := make(chan string, 1)
+	broker.ClientConnectedHandler = func(clientID string) { connected <- clientID }
+
+	router := chi.NewRouter()
+	router.Use(compress)
+
+	api := NewThingAPI()
+	api.addPublicRoutes(router)
+	api.AddOpenAPIEndpoint(router, "openapi")
+
+	router.Get("/events", func(w http.ResponseWriter, r *http.Request) {
+		_ = broker.Stream("client1", w, *r)
+	})
+
+	// Real server, as flushing can't be seen with a recorder
+	srv := httptest.NewServer(router)
+	defer srv.CloseClientConnections()
+
+	get := func(path string, headers map[string]string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request to %s failed: %s", path, err)
+		}
+
+		return resp
+	}
+
+	resp := get("/openapi", map[string]string{"Accept-Encoding": "br;q=1.0, zstd;q=0.5, gzip;q=0.8"})
+	resp.Body.Close()
+
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("Expected gzip, the best supported encoding, got '%s'", resp.Header.Get("Content-Encoding"))
+	}
+
+	// Under the minimum size
+	resp = get("/things/1", map[string]string{"Accept-Encoding": "gzip"})
+	resp.Body.Close()
+
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Small response should not be compressed, got '%s'", resp.Header.Get("Content-Encoding"))
+	}
+
+	// SSE events must arrive as they are sent, not when the response ends
+	// The broker sends no headers until the first event, so send it once the client is connected
+	go func() {
+		broker.SendToClient(<-connected, "hello")
+	}()
+
+	resp = get("/events", map[string]string{"Accept-Encoding": "gzip"})
+	defer resp.Body.Close()
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("SSE stream is not gzipped: %s", err)
+	}
+
+	line, _ := bufio.NewReader(gz).ReadString('\n')
+	if line != "event: message\n" {
+		t.Errorf("Expected an SSE event, got '%s'", line)
+	}
+
+	// Gzipped request bodies are decompressed before binding
+	body := &bytes.Buffer{}
+	zw := gzip.NewWriter(body)
+	_, _ = zw.Write([]byte(`{"name":"Zipped"}`))
+	_ = zw.Close()
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:           "gzipped request body",
+			URL:            "/things",
+			Method:         "POST",
+			Body:           body.String(),
+			Headers:        map[string]string{"Content-Type": "application/json", "Content-Encoding": "gzip"},
+			CheckBody:      `{"name":"Zipped"}`,
+			CheckBodyCount: 1,
+			CheckStatus:    201,
+		},
+		{
+			Name:        "unsupported request encoding",
+			URL:         "/things",
+			Method:      "POST",
+			Body:        `{"name":"Zipped"}`,
+			Headers:     map[string]string{"Content-Type": "application/json", "Content-Encoding": "br"},
+			CheckStatus: 415,
+		},
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	// Stand in for the Dapr sidecar and a downstream service, recording the request IDs they get
+	forwarded := make(chan string, 2)
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get(requestid.Header)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer stub.Close()
+
+	t.Setenv("DAPR_HTTP_PORT", stub.URL[strings.LastIndex(stub.URL, ":")+1:])
+
+	router := chi.NewRouter()
+	router.Use(requestid.Middleware)
+
+	api := NewThingAPI()
+	api.addPublicRoutes(router)
+
+	router.Get("/calls-out", func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, stub.URL, nil)
+		resp, err := requestid.NewClient().Do(req)
+		if err != nil {
+			t.Errorf("Downstream call failed: %s", err)
+		} else {
+			resp.Body.Close()
+		}
+
+		if err := pubsub.Publish(r.Context(), "pubsub", "things", ThingResp{Name: "Event"}); err != nil {
+			t.Errorf("Publish failed: %s", err)
+		}
+	})
+
+	// The context holds the request ID even if the response header has been changed
+	router.Get("/header-removed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Del(requestid.Header)
+		problem.New("teapot", "I'm a teapot", http.StatusTeapot, "", r.RequestURI).SendWithRequest(w, r)
+	})
+
+	// The same problem sent to every request, each response has its own request ID
+	shared := problem.New("gone", "Gone", http.StatusGone, "", "/gone")
+	router.Get("/gone", func(w http.ResponseWriter, r *http.Request) {
+		shared.SendWithRequest(w, r)
+	})
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:           "request ID in problem from context",
+			URL:            "/header-removed",
+			Method:         "GET",
+			Headers:        map[string]string{requestid.Header: "abc-789"},
+			CheckBody:      `"requestId":"abc-789"`,
+			CheckBodyCount: 1,
+			CheckStatus:    418,
+		},
+		{
+			Name:           "shared problem first request",
+			URL:            "/gone",
+			Method:         "GET",
+			Headers:        map[string]string{requestid.Header: "gone-1"},
+			CheckBody:      `"requestId":"gone-1"`,
+			CheckBodyCount: 1,
+			CheckStatus:    410,
+		},
+		{
+			Name:           "shared problem second request",
+			URL:            "/gone",
+			Method:         "GET",
+			Headers:        map[string]string{requestid.Header: "gone-2"},
+			CheckBody:      `"requestId":"gone-2"`,
+			CheckBodyCount: 1,
+			CheckStatus:    410,
+		},
+		{
+			Name:           "request ID in problem",
+			URL:            "/things/99",
+			Method:         "GET",
+			Headers:        map[string]string{requestid.Header: "abc-123"},
+			CheckBody:      `"requestId":"abc-123"`,
+			CheckBodyCount: 1,
+			CheckStatus:    404,
+			CheckHeaders:   map[string]string{requestid.Header: "^abc-123$"},
+		},
+		{
+			Name:         "request ID generated",
+			URL:          "/things/1",
+			Method:       "GET",
+			CheckStatus:  200,
+			CheckHeaders: map[string]string{requestid.Header: "^[0-9a-f]{32}$"},
+		},
+		{
+			Name:         "unsafe request ID replaced",
+			URL:          "/things/1",
+			Method:       "GET",
+			Headers:      map[string]string{requestid.Header: "bad\tid"},
+			CheckStatus:  200,
+			CheckHeaders: map[string]string{requestid.Header: "^[0-9a-f]{32}$"},
+		},
+		{
+			Name:        "request ID forwarded",
+			URL:         "/calls-out",
+			Method:      "GET",
+			Headers:     map[string]string{requestid.Header: "abc-456"},
+			CheckStatus: 200,
+		},
+	})
+
+	for _, name := range []string{"downstream call", "publish"} {
+		if id := <-forwarded; id != "abc-456" {
+			t.Errorf("Request ID not forwarded on %s, got '%s'", name, id)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	// Stub OpenTelemetry collector
+	received := make(chan string, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r.URL.Path + " " + string(body)
+	}))
+	defer collector.Close()
+
+	// Downstream service, to check the trace is passed on
+	downstream := make(chan string, 1)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downstream <- r.Header.Get("traceparent")
+	}))
+	defer other.Close()
+
+	exporter := trace.NewOTLPExporter(collector.URL, "thing", trace.OTLPOptions{FlushInterval: time.Hour})
+	trace.SetExporter(exporter)
+
+	defer trace.SetExporter(nil)
+
+	router := chi.NewRouter()
+	router.Use(trace.Middleware)
+
+	api := NewThingAPI()
+	api.AddMetricsEndpoint(router, "metrics")
+	api.addPublicRoutes(router)
+
+	router.Get("/calls-out", func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, other.URL, nil)
+		_, _ = (&http.Client{Transport: trace.Transport{}}).Do(req)
+	})
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	// Latency of the traced request, with the trace ID as an exemplar
+	exemplar := `http_request_duration_seconds_bucket{method="GET",route="/things/{id}",status="200",le="[^"]+"} 1 ` +
+		`# {trace_id="` + traceID + `"}`
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:        "continue trace",
+			URL:         "/things/1",
+			Method:      "GET",
+			Headers:     map[string]string{"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"},
+			CheckStatus: 200,
+		},
+		{
+			Name:        "not sampled by caller",
+			URL:         "/things/2",
+			Method:      "GET",
+			Headers:     map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"},
+			CheckStatus: 404,
+		},
+		{
+			Name:        "trace passed downstream",
+			URL:         "/calls-out",
+			Method:      "GET",
+			Headers:     map[string]string{"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"},
+			CheckStatus: 200,
+		},
+		{
+			Name:           "trace ID exemplar",
+			URL:            "/metrics",
+			Method:         "GET",
+			Headers:        map[string]string{"Accept": "application/openmetrics-text; version=1.0.0"},
+			CheckBody:      exemplar,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+	})
+
+	if tp := <-downstream; !strings.HasPrefix(tp, "00-"+traceID+"-") {
+		t.Errorf("Trace not passed downstream, got traceparent '%s'", tp)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := exporter.ForceFlush(ctx); err != nil {
+		t.Fatalf("Flush failed: %s", err)
+	}
+
+	export := <-received
+
+	checks := []string{
+		`^/v1/traces `,
+		`{"key":"service.name","value":{"stringValue":"thing"}}`,
+		`"traceId":"` + traceID + `","spanId":"[0-9a-f]{16}","parentSpanId":"00f067aa0ba902b7",` +
+			`"name":"GET /things/{id}","kind":2`,
+		`"name":"GET /calls-out","kind":2`,
+		`"name":"GET","kind":3`,
+	}
+
+	for _, check := range checks {
+		if !regexp.MustCompile(check).MatchString(export) {
+			t.Errorf("Exported spans don't match '%s'\n%s", check, export)
+		}
+	}
+
+	if strings.Contains(export, "0af7651916cd43dd8448eb211c80319c") {
+		t.Errorf("Unsampled span was exported")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	global := api.NewRateLimiter(api.RateLimit{Requests: 3, Window: time.Minute}, api.KeyByHeader("X-API-Key"))
+	perRoute := api.NewRateLimiter(api.RateLimit{
+		Requests:  1,
+		Window:    time.Minute,
+		Algorithm: api.SlidingWindow,
+	}, api.KeyByIP())
+
+	router := chi.NewRouter()
+	router.Use(global.Middleware)
+
+	api := NewThingAPI()
+	api.addPublicRoutes(router)
+
+	router.With(perRoute.Middleware).Get("/limited", func(w http.ResponseWriter, r *http.Request) {})
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:        "first request",
+			URL:         "/things/1",
+			Method:      "GET",
+			Headers:     map[string]string{"X-API-Key": "key1"},
+			CheckStatus: 200,
+			CheckHeaders: map[string]string{
+				"RateLimit-Limit":     "^3$",
+				"RateLimit-Remaining": "^2$",
+				"RateLimit-Reset":     "^20$",
+				"RateLimit-Policy":    "^3;w=60$",
+				"Retry-After":         "^$",
+			},
+		},
+		{
+			Name:         "second request",
+			URL:          "/things/1",
+			Method:       "GET",
+			Headers:      map[string]string{"X-API-Key": "key1"},
+			CheckStatus:  200,
+			CheckHeaders: map[string]string{"RateLimit-Remaining": "^1$"},
+		},
+		{
+			Name:         "per route limit, separate from the global one",
+			URL:          "/limited",
+			Method:       "GET",
+			Headers:      map[string]string{"X-API-Key": "key1"},
+			CheckStatus:  200,
+			CheckHeaders: map[string]string{"RateLimit-Limit": "^1$", "RateLimit-Remaining": "^0$", "Retry-After": "^[0-9]+$"},
+		},
+		{
+			Name:           "per route limit exceeded",
+			URL:            "/limited",
+			Method:         "GET",
+			Headers:        map[string]string{"X-API-Key": "key2"},
+			CheckBody:      `"status":429,"detail":"rate limit of 1 requests per 1m0s exceeded`,
+			CheckBodyCount: 1,
+			CheckStatus:    429,
+			CheckHeaders:   map[string]string{"Retry-After": "^[0-9]+$"},
+		},
+		{
+			Name:           "global limit exceeded",
+			URL:            "/things/1",
+			Method:         "GET",
+			Headers:        map[string]string{"X-API-Key": "key1"},
+			CheckBody:      `"type":"too-many-requests"`,
+			CheckBodyCount: 1,
+			CheckStatus:    429,
+			CheckHeaders:   map[string]string{"RateLimit-Remaining": "^0$", "Retry-After": "^20$"},
+		},
+		{
+			Name:        "other clients are counted separately",
+			URL:         "/things/1",
+			Method:      "GET",
+			Headers:     map[string]string{"X-API-Key": "key2"},
+			CheckStatus: 200,
+		},
+	})
+
+}
+
+func TestRateLimitAlgorithms(t *testing.T) {
+	store := api.NewMemoryRateLimitStore()
+	bucket := api.RateLimit{Requests: 2, Window: 10 * time.Second}
+	window := api.RateLimit{Requests: 2, Window: 10 * time.Second, Algorithm: api.SlidingWindow}
+
+	// Fake clock, so the refill & window maths can be checked exactly
+	now := time.Unix(1_000_000, 0)
+
+	steps := []struct {
+		limit  api.RateLimit
+		offset time.Duration
+		want   bool
+	}{
+		{bucket, 0, true},
+		{bucket, 0, true},
+		{bucket, time.Second, false},
+		// One token refilled every 5 seconds
+		{bucket, 5 * time.Second, true},
+		{bucket, 6 * time.Second, false},
+		{window, 0, true},
+		{window, 0, true},
+		{window, 9 * time.Second, false},
+		// Half way into the next window the previous one counts for half
+		{window, 15 * time.Second, true},
+		{window, 15 * time.Second, false},
+		{window, 30 * time.Second, true},
+	}
+
+	for i, step := range steps {
+		result, _ := store.Take(context.Background(), fmt.Sprint(step.limit.Algorithm), step.limit, now.Add(step.offset))
+		if got := result.Allowed; got != step.want {
+			t.Errorf("Step %d: allowed %v, wanted %v", i, got, step.want)
+		}
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	idempotency := api.NewIdempotency(time.Minute)
+	idempotency.MaxBodyBytes = 32
+	created := 0
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	router := chi.NewRouter()
+	router.Use(requestid.Middleware)
+	router.Use(idempotency.Middleware)
+
+	router.Post("/things", func(w http.ResponseWriter, r *http.Request) {
+		created++
+		body, _ := io.ReadAll(r.Body)
+
+		w.Header().Set("Location", fmt.Sprintf("/things/%d", created))
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"id":%d,"body":%s}`, created, body)
+	})
+
+	router.Post("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	router.Post("/fail", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:           "first request is handled",
+			URL:            "/things",
+			Method:         "POST",
+			Body:           `{"name":"Toast"}`,
+			Headers:        map[string]string{"Idempotency-Key": "key1"},
+			CheckBody:      `{"id":1,"body":{"name":"Toast"}}`,
+			CheckBodyCount: 1,
+			CheckStatus:    201,
+			CheckHeaders:   map[string]string{"Location": "^/things/1$", "Idempotent-Replayed": "^$"},
+		},
+		{
+			Name:           "retry is replayed",
+			URL:            "/things",
+			Method:         "POST",
+			Body:           `{"name":"Toast"}`,
+			Headers:        map[string]string{"Idempotency-Key": "key1", "X-Request-ID": "retry-1"},
+			CheckBody:      `{"id":1,"body":{"name":"Toast"}}`,
+			CheckBodyCount: 1,
+			CheckStatus:    201,
+			CheckHeaders: map[string]string{
+				"Location":            "^/things/1$",
+				"Idempotent-Replayed": "^true$",
+				"X-Request-ID":        "^retry-1$",
+			},
+		},
+		{
+			Name:           "same key with a different body",
+			URL:            "/things",
+			Method:         "POST",
+			Body:           `{"name":"Crumpets"}`,
+			Headers:        map[string]string{"Idempotency-Key": "key1"},
+			CheckBody:      `"status":422,"detail":"the Idempotency-Key has already been used for a different request"`,
+			CheckBodyCount: 1,
+			CheckStatus:    422,
+		},
+		{
+			Name:           "same key for a different principal",
+			URL:            "/things",
+			Method:         "POST",
+			Body:           `{"name":"Toast"}`,
+			Headers:        map[string]string{"Idempotency-Key": "key1", "Authorization": "Bearer someone-else"},
+			CheckBody:      `{"id":2,`,
+			CheckBodyCount: 1,
+			CheckStatus:    201,
+		},
+		{
+			Name:           "no key is handled every time",
+			URL:            "/things",
+			Method:         "POST",
+			Body:           `{"name":"Toast"}`,
+			CheckBody:      `{"id":3,`,
+			CheckBodyCount: 1,
+			CheckStatus:    201,
+		},
+		{
+			Name:           "body over the limit",
+			URL:            "/things",
+			Method:         "POST",
+			Body:           `{"name":"` + strings.Repeat("Toast", 10) + `"}`,
+			Headers:        map[string]string{"Idempotency-Key": "key4"},
+			CheckBody:      `"status":413,"detail":"body must be no more than 32 bytes"`,
+			CheckBodyCount: 1,
+			CheckStatus:    413,
+		},
+		{
+			Name:        "server errors are not stored",
+			URL:         "/fail",
+			Method:      "POST",
+			Headers:     map[string]string{"Idempotency-Key": "key2"},
+			CheckStatus: 503,
+		},
+		{
+			Name:         "server errors can be retried",
+			URL:          "/fail",
+			Method:       "POST",
+			Headers:      map[string]string{"Idempotency-Key": "key2"},
+			CheckStatus:  503,
+			CheckHeaders: map[string]string{"Idempotent-Replayed": "^$"},
+		},
+	})
+
+	// A retry while the first request is still in flight gets a conflict
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		req := httptest.NewRequest("POST", "/slow", nil)
+		req.Header.Set("Idempotency-Key", "key3")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	<-started
+
+	req := httptest.NewRequest("POST", "/slow", nil)
+	req.Header.Set("Idempotency-Key", "key3")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusConflict || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Got status %d wanted 409 with Retry-After while the first request is in flight", rec.Code)
+	}
+
+	close(release)
+	<-done
+}
+
+func TestCompressedETags(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	doc := []byte(`{"text":"` + strings.Repeat("toast ", 500) + `"}`)
+	tag := api.ETag(doc)
+
+	router := chi.NewRouter()
+	router.Use(api.CompressMiddleware(api.DefaultCompressOptions))
+	router.Use(api.RequirePreconditions(func(r *http.Request) (string, time.Time, error) {
+		return tag, time.Time{}, nil
+	}, false))
+
+	router.With(api.ETagMiddleware(false)).Get("/doc", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(doc)
+	})
+	router.Put("/doc", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	send := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/doc", nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	rec := send(http.MethodGet, map[string]string{"Accept-Encoding": "gzip"})
+	gzTag := rec.Header().Get("ETag")
+
+	if rec.Header().Get("Content-Encoding") != "gzip" || gzTag == tag || strings.HasPrefix(gzTag, "W/") {
+		t.Fatalf("Compressed GET: got ETag %s, wanted a strong tag differing from %s", gzTag, tag)
+	}
+
+	// The tag from the compressed response is sent back to update the resource
+	if rec = send(http.MethodPut, map[string]string{"If-Match": gzTag}); rec.Code != http.StatusNoContent {
+		t.Errorf("PUT with If-Match %s: got %d, wanted 204", gzTag, rec.Code)
+	}
+
+	rec = send(http.MethodPut, map[string]string{"If-Match": `"stale-gzip"`})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with a stale If-Match: got %d, wanted 412", rec.Code)
+	}
+
+	rec = send(http.MethodGet, map[string]string{"Accept-Encoding": "gzip", "If-None-Match": gzTag})
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("GET with If-None-Match %s: got %d, wanted 304", gzTag, rec.Code)
+	}
+}
+
+func TestCompressionPanics(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	compress := api.CompressMiddleware(api.DefaultCompressOptions)
+	timeout := api.Timeout(time.Second)
+
+	router := chi.NewRouter()
+	api := NewThingAPI()
+	router.Use(api.RecoverMiddleware)
+	router.Use(compress)
+
+	router.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("partial"))
+
+		panic("oh no")
+	})
+
+	router.With(timeout).Get("/timeout-panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("oh no")
+	})
+
+	// Real server, so a second WriteHeader is logged rather than ignored
+	serverLog := &bytes.Buffer{}
+	srv := httptest.NewUnstartedServer(router)
+	srv.Config.ErrorLog = log.New(serverLog, "", 0)
+	srv.Start()
+
+	for _, path := range []string{"/panic", "/timeout-panic"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request to %s failed: %s", path, err)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: got %d %s, wanted a 500 problem", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+
+		if strings.Contains(string(body), "partial") || !strings.Contains(string(body), `"type":"internal-server-error"`) {
+			t.Errorf("%s: got body %q, wanted only the problem", path, body)
+		}
+	}
+
+	srv.Close()
+
+	if strings.Contains(serverLog.String(), "superfluous") {
+		t.Errorf("Headers were written twice: %s", serverLog.String())
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	short := api.Timeout(50 * time.Millisecond)
+	long := api.Timeout(time.Second)
+	stream := api.StreamTimeout(time.Second)
+
+	router := chi.NewRouter()
+	api := NewThingAPI()
+	router.Use(api.RecoverMiddleware)
+
+	router.With(short).Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	router.With(long).Get("/fast", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Error("Handler context has no deadline")
+		}
+
+		w.Header().Set("X-Thing", "toast")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("done"))
+	})
+
+	router.With(long).Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("oh no")
+	})
+
+	// Sends for longer than the server's WriteTimeout
+	streamFor := func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			_, _ = fmt.Fprintf(w, "line %d\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	router.With(stream).Get("/stream", streamFor)
+	router.Get("/stream-cut", streamFor)
+
+	server := httptest.NewUnstartedServer(router)
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Start()
+
+	defer server.Close()
+
+	get := func(path string) (*http.Response, string, error) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			return nil, "", err
+		}
+
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+
+		return resp, string(body), err
+	}
+
+	resp, body, err := get("/slow")
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable ||
+		!strings.Contains(body, `"detail":"request timed out after 50ms"`) {
+		t.Errorf("Slow handler: got %v %s, wanted a 503 problem", err, body)
+	}
+
+	resp, body, err = get("/fast")
+	if err != nil || resp.StatusCode != http.StatusAccepted || body != "done" || resp.Header.Get("X-Thing") != "toast" {
+		t.Errorf("Fast handler: got %v %s, wanted the handler's response", err, body)
+	}
+
+	resp, body, err = get("/panic")
+	if err != nil || resp.StatusCode != http.StatusInternalServerError ||
+		!strings.Contains(body, `"type":"internal-server-error"`) {
+		t.Errorf("Panicking handler: got %v %s, wanted a 500 problem", err, body)
+	}
+
+	_, body, err = get("/stream")
+	if err != nil || strings.Count(body, "line") != 5 {
+		t.Errorf("Stream: got %v %q, wanted all 5 lines", err, body)
+	}
+
+	// Without StreamTimeout the server's WriteTimeout ends the stream early
+	_, body, err = get("/stream-cut")
+	if err == nil && strings.Count(body, "line") == 5 {
+		t.Errorf("Stream without StreamTimeout was not cut off")
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	fixed := api.NewConcurrencyLimiter("test", api.ConcurrencyOptions{Limit: 1, RetryAfter: 2 * time.Second})
+	aimd := api.NewConcurrencyLimiter("test-aimd", api.ConcurrencyOptions{
+		Algorithm:        api.AIMD,
+		Limit:            10,
+		LatencyThreshold: time.Millisecond,
+	})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	router := chi.NewRouter()
+	router.Use(fixed.Middleware)
+
+	api := NewThingAPI()
+	api.AddMetricsEndpoint(router, "metrics")
+	api.AddProbeEndpoints(router)
+
+	router.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	router.With(aimd.Middleware).Get("/aimd", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+	})
+
+	// Hold the only slot
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	}()
+
+	<-started
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:           "request over the limit is shed",
+			URL:            "/things",
+			Method:         "GET",
+			CheckBody:      `"status":503,"detail":"server is overloaded, retry in 2s"`,
+			CheckBodyCount: 1,
+			CheckStatus:    503,
+			CheckHeaders:   map[string]string{"Retry-After": "^2$"},
+		},
+		{
+			Name:        "probes get through",
+			URL:         "/livez",
+			Method:      "GET",
+			CheckStatus: 200,
+		},
+		{
+			Name:           "metrics get through",
+			URL:            "/metrics",
+			Method:         "GET",
+			CheckBody:      `http_concurrency_(limit|in_flight|shed_total){limiter="test"} 1\n`,
+			CheckBodyCount: 3,
+			CheckStatus:    200,
+		},
+	})
+
+	close(release)
+	<-done
+
+	if fixed.InFlight() != 0 {
+		t.Errorf("Got %d requests in flight, wanted 0", fixed.InFlight())
+	}
+
+	// Slow requests cut the AIMD limit
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/aimd", nil))
+
+	if aimd.Limit() != 9 {
+		t.Errorf("Got AIMD limit %d, wanted 9 after a slow request", aimd.Limit())
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	// Test requests come from 192.0.2.1
+	trusted, err := api.NewTrustedProxies("192.0.2.0/24", "10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	untrusted, _ := api.NewTrustedProxies()
+
+	if _, err := api.NewTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("Invalid CIDR was accepted")
+	}
+
+	secure := api.SecurityHeadersMiddleware(api.DefaultSecurityHeaders)
+	relaxed := api.SecurityHeadersMiddleware(api.SecurityHeaders{ContentSecurityPolicy: "default-src 'self'"})
+
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s|%s|%s|%s", r.RemoteAddr, r.URL.Scheme, r.Host, r.Header.Get("X-Forwarded-For"))
+	}
+
+	// Proxies come first, so the security headers know if the client used HTTPS
+	router := chi.NewRouter()
+	router.With(trusted.Middleware, secure).Get("/trusted", echo)
+	router.With(untrusted.Middleware, secure).Get("/untrusted", echo)
+	router.With(trusted.Middleware, secure, relaxed).Get("/relaxed", echo)
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:           "client from X-Forwarded-For",
+			URL:            "/trusted",
+			Method:         "GET",
+			Headers:        map[string]string{"X-Forwarded-For": "203.0.113.7, 10.0.0.5"},
+			CheckBody:      `^203\.0\.113\.7\|\|example\.com\|`,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+		{
+			Name:           "spoofed addresses before the first untrusted one are ignored",
+			URL:            "/trusted",
+			Method:         "GET",
+			Headers:        map[string]string{"X-Forwarded-For": "1.1.1.1, 203.0.113.7", "X-Forwarded-Proto": "http"},
+			CheckBody:      `^203\.0\.113\.7\|http\|`,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+		{
+			Name:   "client, scheme & host from Forwarded",
+			URL:    "/trusted",
+			Method: "GET",
+			Headers: map[string]string{
+				"Forwarded":       `for="[2001:db8::1]:4711";proto=https;host=api.example.com, for=10.0.0.5`,
+				"X-Forwarded-For": "1.1.1.1",
+			},
+			CheckBody:      `^2001:db8::1\|https\|api\.example\.com\|`,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+			CheckHeaders: map[string]string{
+				"Strict-Transport-Security": "^max-age=63072000; includeSubDomains$",
+				"Content-Security-Policy":   "^default-src 'none'; frame-ancestors 'none'$",
+				"X-Content-Type-Options":    "^nosniff$",
+				"Referrer-Policy":           "^no-referrer$",
+				"Permissions-Policy":        "camera=\\(\\)",
+			},
+		},
+		{
+			Name:           "unknown client in Forwarded stops at the proxy",
+			URL:            "/trusted",
+			Method:         "GET",
+			Headers:        map[string]string{"Forwarded": `for=unknown, for=10.0.0.5`},
+			CheckBody:      `^10\.0\.0\.5\|`,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+		{
+			Name:           "headers from untrusted peers are removed",
+			URL:            "/untrusted",
+			Method:         "GET",
+			Headers:        map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Proto": "https"},
+			CheckBody:      `^192\.0\.2\.1:1234\|\|example\.com\|$`,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+			CheckHeaders:   map[string]string{"Strict-Transport-Security": "^$", "X-Content-Type-Options": "^nosniff$"},
+		},
+		{
+			Name:           "security headers overridden for a route",
+			URL:            "/relaxed",
+			Method:         "GET",
+			CheckBody:      `192\.0\.2\.1`,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+			CheckHeaders: map[string]string{
+				"Content-Security-Policy": "^default-src 'self'$",
+				"Referrer-Policy":         "^no-referrer$",
+			},
+		},
+	})
+}
+
+func TestCORS(t *testing.T) {
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+
+	defer log.SetOutput(io.Discard)
+
+	cors, err := api.NewCORS(api.CORSPolicy{
+		AllowedOrigins:        []string{"https://app.example.com", "https://*.example.net"},
+		AllowedOriginPatterns: []string{`http://localhost:\d+`},
+		AllowedMethods:        []string{"GET", "POST", "DELETE"},
+		ExposedHeaders:        []string{"ETag", "X-Request-ID"},
+		AllowCredentials:      true,
+		MaxAge:                10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cors.Group("/public", api.CORSPolicy{AllowedOrigins: []string{"*"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := api.NewCORS(api.CORSPolicy{AllowedOrigins: []string{"*"}, AllowCredentials: true}); err == nil {
+		t.Error("Any origin with credentials was accepted")
+	}
+
+	if _, err := api.NewCORS(api.CORSPolicy{AllowedOrigins: []string{"https://app.*.com"}}); err == nil {
+		t.Error("Wildcard that isn't a subdomain was accepted")
+	}
+
+	router := chi.NewRouter()
+	router.Use(cors.Middleware)
+
+	api := NewThingAPI()
+	api.addPublicRoutes(router)
+	router.Get("/public/things", func(w http.ResponseWriter, r *http.Request) {})
+
+	preflight := func(origin string, method string, headers string) map[string]string {
+		return map[string]string{
+			"Origin":                         origin,
+			"Access-Control-Request-Method":  method,
+			"Access-Control-Request-Headers": headers,
+		}
+	}
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:        "preflight from an allowed origin",
+			URL:         "/things",
+			Method:      "OPTIONS",
+			Headers:     preflight("https://app.example.com", "POST", "Content-Type, Authorization"),
+			CheckStatus: 204,
+			CheckHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "^https://app.example.com$",
+				"Access-Control-Allow-Credentials": "^true$",
+				"Access-Control-Allow-Methods":     "^GET, POST, DELETE$",
+				"Access-Control-Allow-Headers":     "^Content-Type, Authorization$",
+				"Access-Control-Max-Age":           "^600$",
+				"Vary":                             "^Origin$",
+			},
+		},
+		{
+			Name:         "preflight from a wildcard subdomain",
+			URL:          "/things",
+			Method:       "OPTIONS",
+			Headers:      preflight("https://a.b.example.net", "GET", ""),
+			CheckStatus:  204,
+			CheckHeaders: map[string]string{"Access-Control-Allow-Origin": "^https://a.b.example.net$"},
+		},
+		{
+			Name:         "preflight from an origin matching a pattern",
+			URL:          "/things",
+			Method:       "OPTIONS",
+			Headers:      preflight("http://localhost:3000", "DELETE", ""),
+			CheckStatus:  204,
+			CheckHeaders: map[string]string{"Access-Control-Allow-Origin": "^http://localhost:3000$"},
+		},
+		{
+			Name:         "preflight from an unknown origin",
+			URL:          "/things",
+			Method:       "OPTIONS",
+			Headers:      preflight("https://example.net", "GET", ""),
+			CheckStatus:  204,
+			CheckHeaders: map[string]string{"Access-Control-Allow-Origin": "^$", "Access-Control-Allow-Methods": "^$"},
+		},
+		{
+			Name:         "preflight for a method not allowed",
+			URL:          "/things",
+			Method:       "OPTIONS",
+			Headers:      preflight("https://app.example.com", "PUT", ""),
+			CheckStatus:  204,
+			CheckHeaders: map[string]string{"Access-Control-Allow-Origin": "^$"},
+		},
+		{
+			Name:         "preflight for a header not allowed",
+			URL:          "/things",
+			Method:       "OPTIONS",
+			Headers:      preflight("http://localhost:8080", "POST", "X-Custom"),
+			CheckStatus:  204,
+			CheckHeaders: map[string]string{"Access-Control-Allow-Origin": "^$"},
+		},
+		{
+			Name:        "request from an allowed origin",
+			URL:         "/things/1",
+			Method:      "GET",
+			Headers:     map[string]string{"Origin": "https://app.example.com"},
+			CheckStatus: 200,
+			CheckHeaders: map[string]string{
+				"Access-Control-Allow-Origin":   "^https://app.example.com$",
+				"Access-Control-Expose-Headers": "^ETag, X-Request-ID$",
+			},
+		},
+		{
+			Name:         "request from an unknown origin",
+			URL:          "/things/1",
+			Method:       "GET",
+			Headers:      map[string]string{"Origin": "https://evil.example.com"},
+			CheckStatus:  200,
+			CheckHeaders: map[string]string{"Access-Control-Allow-Origin": "^$"},
+		},
+		{
+			Name:        "group policy",
+			URL:         "/public/things",
+			Method:      "GET",
+			Headers:     map[string]string{"Origin": "https://evil.example.com"},
+			CheckStatus: 200,
+			CheckHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      `^\*$`,
+				"Access-Control-Allow-Credentials": "^$",
+			},
+		},
+	})
+
+	for _, reason := range []string{
+		"rejected preflight from 'https://example.net' for GET /things: origin not allowed",
+		"for PUT /things: method PUT not allowed, use one of: GET, POST, DELETE",
+		"header X-Custom not allowed",
+	} {
+		if !strings.Contains(logs.String(), reason) {
+			t.Errorf("Rejected preflight not logged with '%s'", reason)
+		}
+	}
+}
+
+func TestPrincipal(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	// Stub JWKS endpoint with the public key
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	defer jwks.Close()
+
+	sign := func(signKey *rsa.PrivateKey, claims jwt.MapClaims) string {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test"
+		signed, _ := token.SignedString(signKey)
+
+		return "Bearer " + signed
+	}
+
+	alice := jwt.MapClaims{
+		"sub":                "alice",
+		"tid":                "tenant-1",
+		"aud":                "api://client-id",
+		"scp":                "Things.Read Some.Scope",
+		"roles":              []string{"admin", "reader"},
+		"preferred_username": "alice@example.com",
+		"address":            map[string]any{"country": "UK"},
+		"groups":             []map[string]any{{"name": "toast"}},
+	}
+
+	// What /me sends for alice, the principal's fields separated by |
+	aliceFields := `^alice\|tenant-1\|\[Things.Read Some.Scope\]\|\[admin reader\]\|true\|UK\|toast\|true\|false\|` +
+		`alice@example.com\|alice@example.com$`
+
+	bob := jwt.MapClaims{"sub": "bob", "aud": "client-id", "scp": "Some.Scope"}
+	partialScope := jwt.MapClaims{"aud": "client-id", "scp": "Some.Scope.Write"}
+	wrongAudience := jwt.MapClaims{"aud": "someone-else", "scp": "Some.Scope"}
+
+	validator := auth.NewJWTValidator("client-id", jwks.URL, "Some.Scope")
+	limiter := api.NewRateLimiter(api.RateLimit{Requests: 1, Window: time.Minute}, api.KeyByClaim("sub"))
+	enrichedValue := api.EnrichedValue
+
+	router := chi.NewRouter()
+	router.Use(validator.Middleware)
+
+	api := NewThingAPI()
+	router.Use(api.JWTRequestEnricher("user", "preferred_username"))
+
+	router.Get("/me", func(w http.ResponseWriter, r *http.Request) {
+		p := auth.PrincipalFrom(r.Context())
+		country, _ := auth.Claim[string](p, "address", "country")
+		group, _ := auth.Claim[string](p, "groups", "0", "name")
+		expires, _ := auth.Claim[time.Time](p, "exp")
+		_, isNumber := auth.Claim[int](p, "sub")
+
+		_, _ = fmt.Fprintf(w, "%s|%s|%v|%v|%v|%s|%s|%v|%v|%s|%v", p.Subject, p.Tenant, p.Scopes, p.Roles,
+			p.HasRole("admin"), country, group, expires.After(time.Now()), isNumber, enrichedValue(r.Context(), "user"),
+			r.Context().Value("user"))
+	})
+
+	router.With(limiter.Middleware).Get("/limited", func(w http.ResponseWriter, r *http.Request) {})
+
+	httptester.Run(t, router, []httptester.TestCase{
+		{
+			Name:           "verified principal in the context",
+			URL:            "/me",
+			Method:         "GET",
+			Headers:        map[string]string{"Authorization": sign(key, alice)},
+			CheckBody:      aliceFields,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+		{
+			Name:   "audience array & scope array",
+			URL:    "/me",
+			Method: "GET",
+			Headers: map[string]string{"Authorization": sign(key, jwt.MapClaims{
+				"sub": "bob", "aud": []string{"other", "client-id"}, "scp": []string{"Some.Scope"},
+			})},
+			CheckBody:      `^bob\|\|\[Some.Scope\]\|\[\]\|false\|`,
+			CheckBodyCount: 1,
+			CheckStatus:    200,
+		},
+		{
+			Name:        "token signed with another key",
+			URL:         "/me",
+			Method:      "GET",
+			Headers:     map[string]string{"Authorization": sign(otherKey, alice)},
+			CheckStatus: 401,
+		},
+		{
+			Name:        "token without dots",
+			URL:         "/me",
+			Method:      "GET",
+			Headers:     map[string]string{"Authorization": "Bearer nodots"},
+			CheckStatus: 401,
+		},
+		{
+			Name:        "non string scope claim",
+			URL:         "/me",
+			Method:      "GET",
+			Headers:     map[string]string{"Authorization": sign(key, jwt.MapClaims{"aud": "client-id", "scp": 42})},
+			CheckStatus: 401,
+		},
+		{
+			Name:        "scope that only partly matches",
+			URL:         "/me",
+			Method:      "GET",
+			Headers:     map[string]string{"Authorization": sign(key, partialScope)},
+			CheckStatus: 401,
+		},
+		{
+			Name:        "wrong audience",
+			URL:         "/me",
+			Method:      "GET",
+			Headers:     map[string]string{"Authorization": sign(key, wrongAudience)},
+			CheckStatus: 401,
+		},
+		{
+			Name:        "rate limited by subject",
+			URL:         "/limited",
+			Method:      "GET",
+			Headers:     map[string]string{"Authorization": sign(key, alice)},
+			CheckStatus: 200,
+		},
+		{
+			Name:        "rate limited by subject, same subject new token",
+			URL:         "/limited",
+			Method:      "GET",
+			Headers:     map[string]string{"Authorization": sign(key, alice)},
+			CheckStatus: 429,
+		},
+		{
+			Name:        "rate limited by subject, other subject",
+			URL:         "/limited",
+			Method:      "GET",
+			Headers:     map[string]string{"Authorization": sign(key, bob)},
+			CheckStatus: 200,
+		},
+	})
+}
+
+// freePort finds a port that's free to listen on
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// newTestCert creates a certificate for localhost & 127.0.0.1, signed by parent or self-signed as a CA
+func newTestCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate,
+	*ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+// writeTestPEM writes the certificate, and the key when there is one, to a PEM file
+func writeTestPEM(t *testing.T, path string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+
+	if key != nil {
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	}
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
 }
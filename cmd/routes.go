@@ -8,64 +8,127 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
-	"github.com/benc-uk/go-rest-api/pkg/problem"
-	"github.com/go-chi/chi/v5"
+	restapi "github.com/benc-uk/go-rest-api/pkg/api"
 )
 
 type ThingResp struct {
 	Name string `json:"name"`
 }
 
-// Get all things, dummy implementation
-func (api ThingAPI) getThings(resp http.ResponseWriter, req *http.Request) {
-	things := make([]ThingResp, 0)
+type ThingID struct {
+	ID string `path:"id" validate:"required"`
+}
 
-	things = append(things, ThingResp{
-		Name: "Cheese On Toast",
-	})
-	things = append(things, ThingResp{
-		Name: "Bacon Sandwich",
-	})
+type CreateThing struct {
+	Name  string   `json:"name" validate:"required,min=2,max=50"`
+	Tags  []string `json:"tags,omitempty" validate:"max=5"`
+	Owner string   `json:"owner,omitempty" validate:"email"`
+}
 
-	api.ReturnJSON(resp, things)
+var allThings = []ThingResp{
+	{Name: "Cheese On Toast"},
+	{Name: "Bacon Sandwich"},
+	{Name: "Beans On Toast"},
+	{Name: "Fish Finger Sandwich"},
+	{Name: "Crumpets"},
 }
 
-// Get a thing by ID, dummy implementation
-func (api ThingAPI) getThingByID(resp http.ResponseWriter, req *http.Request) {
-	id := chi.URLParam(req, "id")
+// Fields of a thing that can be used to filter, sort & select when listing
+var thingQuery = restapi.QuerySpec{
+	Filterable: map[string]restapi.FieldKind{"name": restapi.StringField},
+	Sortable:   []string{"name"},
+	Selectable: []string{"name"},
+}
+
+// Creating things honours the Idempotency-Key header, so clients can retry without making duplicates
+var thingIdempotency = restapi.NewIdempotency(24 * time.Hour)
 
-	// Example of using problem package to send a 404
-	if id != "1" {
-		problem.Wrap(404, req.RequestURI, "thing", errors.New("thing not found")).Send(resp)
-		return
+// Get a page of things, dummy implementation
+// Paged with ?limit=N&offset=N or ?cursor=X, with links to other pages in the envelope & Link header
+// Filtered & sorted with ?filter=name contains 'toast'&sort=-name, see thingQuery
+func (api ThingAPI) getThings(ctx context.Context, _ struct{}) (restapi.PageEnvelope[ThingResp], error) {
+	page, prob := api.Paginator.Parse(restapi.RequestFrom(ctx))
+	if prob != nil {
+		return restapi.PageEnvelope[ThingResp]{}, prob
 	}
 
-	thing := ThingResp{
-		Name: "Cheese On Toast",
+	// With a real database you'd turn the filter & sort into the query, here we do it in memory
+	query := restapi.ListQueryFrom(ctx)
+	things := []ThingResp{}
+
+	for _, thing := range allThings {
+		if query.Match(func(string) any { return thing.Name }) {
+			things = append(things, thing)
+		}
+	}
+
+	// Stable sort by each field in reverse, so the first field has the highest precedence
+	for i := len(query.Sort) - 1; i >= 0; i-- {
+		sort := query.Sort[i]
+		slices.SortStableFunc(things, func(a, b ThingResp) int {
+			if sort.Descending {
+				return strings.Compare(b.Name, a.Name)
+			}
+
+			return strings.Compare(a.Name, b.Name)
+		})
 	}
 
-	api.ReturnJSON(resp, thing)
+	total := len(things)
+	start := min(page.Offset, total)
+	end := min(page.Offset+page.Limit, total)
+
+	return restapi.NewPageEnvelope(api.Paginator, things[start:end], page, restapi.PageInfo{
+		Total: &total,
+	}), nil
+}
+
+// Stream all the things, dummy implementation
+// With a real database you'd yield rows as they are read, rather than loading them all first
+func (api ThingAPI) streamThings(w http.ResponseWriter, r *http.Request) {
+	_ = restapi.Stream(w, r, restapi.Items(slices.Values(allThings)))
+}
+
+// Get a thing by ID, dummy implementation
+func (api ThingAPI) getThingByID(ctx context.Context, in ThingID) (*ThingResp, error) {
+	// Wrapping ErrNotFound results in a 404 problem being sent
+	if in.ID != "1" {
+		return nil, fmt.Errorf("thing %s: %w", in.ID, restapi.ErrNotFound)
+	}
+
+	return &ThingResp{
+		Name: "Cheese On Toast",
+	}, nil
 }
 
 // Create a new thing, dummy implementation
-func (api ThingAPI) createThing(resp http.ResponseWriter, req *http.Request) {
-	api.ReturnOKJSON(resp)
+// The body is decoded & validated before we get here, invalid requests are sent a problem listing the fields
+func (api ThingAPI) createThing(ctx context.Context, in CreateThing) (ThingResp, error) {
+	return ThingResp{
+		Name: in.Name,
+	}, nil
 }
 
 // Delete a thing by ID, dummy implementation
-func (api ThingAPI) deleteThing(resp http.ResponseWriter, req *http.Request) {
-	id := chi.URLParam(req, "id")
+func (api ThingAPI) deleteThing(ctx context.Context, in ThingID) (restapi.NoContent, error) {
+	if in.ID != "1" {
+		return restapi.NoContent{}, fmt.Errorf("thing %s: %w", in.ID, restapi.ErrNotFound)
+	}
 
-	// Example of using problem package to send a 404
-	if id != "1" {
-		problem.Wrap(404, req.RequestURI, "thing", errors.New("thing not found")).Send(resp)
-		return
+	// When If-Match is sent it must match the ETag of the thing, so clients don't delete something that's changed
+	current, _ := json.Marshal(ThingResp{Name: "Cheese On Toast"})
+	if prob := restapi.CheckPreconditions(restapi.RequestFrom(ctx), restapi.ETag(current), time.Time{}); prob != nil {
+		return restapi.NoContent{}, prob
 	}
 
-	// Send a 204 No Content response
-	resp.WriteHeader(http.StatusNoContent)
-	api.ReturnText(resp, "Thing deleted")
+	// Returning NoContent sends a 204 No Content response
+	return restapi.NoContent{}, nil
 }
@@ -8,15 +8,19 @@
 package main
 
 import (
+	"context"
+	"log"
 	"os"
 	"regexp"
 	"time"
 
+	"github.com/benc-uk/go-rest-api/pkg/api"
 	"github.com/benc-uk/go-rest-api/pkg/auth"
 	"github.com/benc-uk/go-rest-api/pkg/env"
 	"github.com/benc-uk/go-rest-api/pkg/logging"
+	"github.com/benc-uk/go-rest-api/pkg/requestid"
+	"github.com/benc-uk/go-rest-api/pkg/trace"
 
-	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
 
 	_ "github.com/joho/godotenv/autoload"
@@ -34,18 +38,88 @@ func main() {
 	// Port to listen on, change the default as you see fit
 	serverPort := env.GetEnvInt("PORT", defaultPort)
 
+	// Set ADMIN_PORT to serve the metrics, health & status endpoints on a separate internal-only port
+	adminPort := env.GetEnvInt("ADMIN_PORT", 0)
+
+	// Optional TLS, set TLS_CERT_FILE & TLS_KEY_FILE to enable, and TLS_CLIENT_CA_FILE for mutual TLS
+	tlsOpts := api.TLSOptions{
+		CertFile:     os.Getenv("TLS_CERT_FILE"),
+		KeyFile:      os.Getenv("TLS_KEY_FILE"),
+		ClientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+	}
+
+	// Set OTEL_EXPORTER_OTLP_ENDPOINT to send traces to an OpenTelemetry collector, e.g. http://localhost:4318
+	if otlpEndpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); otlpEndpoint != "" {
+		trace.SetExporter(trace.NewOTLPExporter(otlpEndpoint, serviceName, trace.OTLPOptions{}))
+	}
+
+	// Shed requests when too many are in flight, the limit adapts to latency starting from CONCURRENCY_LIMIT
+	shedder := api.NewConcurrencyLimiter("api", api.ConcurrencyOptions{
+		Algorithm: api.Gradient,
+		Limit:     env.GetEnvInt("CONCURRENCY_LIMIT", 100),
+	})
+
+	// Only trust Forwarded & X-Forwarded-* headers from proxies in TRUSTED_PROXIES, a list of CIDRs or IPs
+	proxies, err := api.NewTrustedProxies(env.GetEnvList("TRUSTED_PROXIES", nil)...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// CORS policy, set CORS_ALLOWED_ORIGINS etc to change it, by default any origin is allowed without credentials
+	// Use cors.Group to set different policies for groups of routes, e.g. cors.Group("/admin", ...)
+	cors, err := api.NewCORS(api.CORSPolicyFromEnv("CORS", api.CORSPolicy{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders: []string{
+			"Accept", "Authorization", "Content-Type", "Idempotency-Key", "If-Match", "If-None-Match", "X-Request-ID",
+		},
+		ExposedHeaders: []string{
+			"ETag", "Location", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "X-Request-ID",
+		},
+		MaxAge: 5 * time.Minute,
+	}))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Security headers on all responses, use SecurityHeadersMiddleware again with With to change them for routes
+	securityHeaders := api.SecurityHeadersMiddleware(api.DefaultSecurityHeaders)
+
+	// Limit each client IP to RATE_LIMIT requests per minute across the API, use With on routes for tighter limits
+	limiter := api.NewRateLimiter(api.RateLimit{
+		Requests: env.GetEnvInt("RATE_LIMIT", 600),
+		Window:   time.Minute,
+	}, api.KeyByIP())
+
+	// Compress responses with zstd, gzip or deflate, and accept gzipped request bodies
+	compress := api.CompressMiddleware(api.DefaultCompressOptions)
+
+	// ETags on GET responses, answering If-None-Match with a 304, use With on routes that don't stream
+	etags := api.ETagMiddleware(false)
+
 	// Core of the REST API
 	router := chi.NewRouter()
 	api := NewThingAPI()
 
 	// Some basic middleware, change as you see fit, see: https://github.com/go-chi/chi#core-middlewares
-	router.Use(middleware.RealIP)
-	// Filtered request logger, exclude /metrics & /health endpoints
-	router.Use(logging.NewFilteredRequestLogger(regexp.MustCompile(`(^/metrics)|(^/health)`)))
-	router.Use(middleware.Recoverer)
-
-	// Some custom middleware for CORS & JWT username
-	router.Use(api.SimpleCORSMiddleware)
+	// Client IP, scheme & host from trusted proxies, must be first so everything else sees the real client
+	router.Use(proxies.Middleware)
+	router.Use(securityHeaders)
+	// Accept or generate a X-Request-ID, must be before the logger so it's included in the logs
+	router.Use(requestid.Middleware)
+	// W3C trace context, a server span per request continuing any trace from the caller
+	router.Use(trace.Middleware)
+	// Filtered request logger, exclude /metrics, /health & probe endpoints
+	router.Use(logging.NewFilteredRequestLogger(regexp.MustCompile(`(^/metrics)|(^/health)|(^/(live|ready|startup)z)`)))
+	// Recover from panics sending a 500 problem, and send problems for unknown routes & methods
+	router.Use(api.RecoverMiddleware)
+	api.AddProblemHandlers(router)
+	// CORS before anything that rejects requests, so browsers can read the errors
+	router.Use(cors.Middleware)
+	// Shed load, rate limit & compress responses, these come after the logger so rejected requests are logged
+	router.Use(shedder.Middleware)
+	router.Use(limiter.Middleware)
+	router.Use(compress)
 
 	// Group of protected routes, this can be all or some of the routes
 	router.Group(func(protectedRouter chi.Router) {
@@ -62,17 +136,33 @@ func main() {
 
 	// Group of anonymous public routes
 	router.Group(func(publicRouter chi.Router) {
+		// Operational endpoints are public unless the admin server is enabled
+		opsRouter := publicRouter
+		if adminPort > 0 {
+			opsRouter = api.EnableAdminServer(adminPort)
+
+			// Metrics are served from the admin router, but we still want to measure the API requests
+			publicRouter.Use(api.MetricsMiddleware)
+		}
+
 		// Add Prometheus metrics endpoint, must be before the other routes
-		api.AddMetricsEndpoint(publicRouter, "metrics")
+		api.AddMetricsEndpoint(opsRouter, "metrics")
 
 		// Add optional root, health & status endpoints
-		api.AddHealthEndpoint(publicRouter, "health", func() bool {
+		api.AddHealthEndpoint(opsRouter, "health", func() bool {
 			// Put some better logic here with a real API
 			return true
 		})
-		api.AddStatusEndpoint(publicRouter, "status")
+		api.AddStatusEndpoint(opsRouter, "status")
+
+		// Kubernetes style liveness, readiness & startup probes, driven by the registered health checks
+		api.AddProbeEndpoints(opsRouter)
 		api.AddOKEndpoint(publicRouter, "")
 
+		// OpenAPI document of all the routes, with a docs page at /openapi/docs
+		// It rarely changes, so clients can revalidate with If-None-Match and get a 304
+		api.AddOpenAPIEndpoint(publicRouter.With(etags), "openapi")
+
 		// Rest of the app routes are public and don't need JWT auth
 		api.addPublicRoutes(publicRouter)
 	})
@@ -84,6 +174,25 @@ func main() {
 	//	IndexFile:  "index.html",
 	//})
 
+	// Lifecycle hooks, use these to open & close database pools, SDK clients etc
+	api.OnStop(func(ctx context.Context) error {
+		log.Printf("### 🧹 Cleaning up resources")
+		return nil
+	})
+
+	// Send any spans still waiting to the collector
+	api.OnStop(trace.Shutdown)
+
 	// Start the API server, this function will block until the server is stopped
-	api.StartServer(serverPort, router, 10*time.Second)
+	// SIGINT or SIGTERM will trigger a graceful shutdown, draining in-flight requests
+	// The timeout applies to the whole server, use api.Timeout & api.StreamTimeout to change it for routes
+	if tlsOpts.CertFile != "" {
+		err = api.StartServerTLS(serverPort, router, 10*time.Second, tlsOpts)
+	} else {
+		err = api.StartServer(serverPort, router, 10*time.Second)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,29 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Separate internal-only admin listener for operational endpoints
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// EnableAdminServer configures a second server on its own port, for internal use only
+// It returns a new router to mount operational endpoints on, e.g. metrics, health & status
+// The admin server is started & gracefully stopped along with the main server by StartServer
+func (b *Base) EnableAdminServer(port int) chi.Router {
+	router := chi.NewRouter()
+
+	b.admin = &http.Server{
+		Handler: router,
+		Addr:    fmt.Sprintf(":%d", port),
+	}
+
+	return router
+}
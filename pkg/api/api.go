@@ -9,43 +9,81 @@ package api
 
 import (
 	"encoding/json"
-	"fmt"
-	"log"
 	"net/http"
 	"time"
 
 	"github.com/benc-uk/go-rest-api/pkg/problem"
-	"github.com/go-chi/chi/v5"
 )
 
 // Base holds a standard set of values for all services & APIs
 type Base struct {
 	ServiceName string
-	Healthy     bool
 	Version     string
 	BuildInfo   string
+
+	// Grace period for draining connections on shutdown, see StartServer
+	ShutdownTimeout time.Duration
+
+	// Used by list endpoints to page results, replace it with one using a fixed secret to keep cursors valid
+	Paginator *Paginator
+
+	startHooks []Hook
+	stopHooks  []Hook
+	certs      *certReloader
+	admin      *http.Server
+	health     *healthRegistry
+	state      *healthTracker
+	encoders   []registeredEncoder
+	spec       *apiSpec
 }
 
 // NewBase creates and returns a new Base API instance
+// The service starts unhealthy if healthy is false, use SetHealth to change it later
 func NewBase(name, ver, info string, healthy bool) *Base {
-	return &Base{
+	level := Healthy
+	if !healthy {
+		level = Unhealthy
+	}
+
+	b := &Base{
 		ServiceName: name,
-		Healthy:     healthy,
 		Version:     ver,
 		BuildInfo:   info,
+
+		ShutdownTimeout: DefaultShutdownTimeout,
+		Paginator:       NewPaginator(nil),
+
+		health: newHealthRegistry(),
+		state:  &healthTracker{state: HealthState{Level: level, Since: time.Now()}},
+		spec:   &apiSpec{},
 	}
+
+	b.registerDefaultEncoders()
+	healthLevel.WithLabelValues(name).Set(float64(level))
+
+	return b
 }
 
-// ReturnJSON sends a JSON response to the client
+// ReturnJSON sends a JSON response to the client, tagged with an ETag of the body if none has been set
+// It has no request so can't answer If-None-Match, use ETagMiddleware on the route for that, or Respond
 func (b *Base) ReturnJSON(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 
 	dataBytes, err := json.Marshal(data)
+	if err == nil {
+		// Honour ?fields= when QuerySpec.Middleware has selected some
+		dataBytes, err = pruneFields(data, dataBytes, selectedFields(w))
+	}
+
 	if err != nil {
 		problem.Wrap(500, "json-encoding", "api-internals", err).Send(w)
 		return
 	}
 
+	if w.Header().Get("ETag") == "" {
+		w.Header().Set("ETag", ETag(dataBytes))
+	}
+
 	_, _ = w.Write(dataBytes)
 }
 
@@ -64,18 +102,3 @@ func (b *Base) ReturnErrorJSON(w http.ResponseWriter, err error) {
 func (b *Base) ReturnOKJSON(w http.ResponseWriter) {
 	b.ReturnJSON(w, map[string]string{"result": "ok"})
 }
-
-// StartServer starts the HTTP server and blocks until it exits
-func (b *Base) StartServer(port int, router chi.Router, timeout time.Duration) {
-	srv := &http.Server{
-		Handler:      router,
-		Addr:         fmt.Sprintf(":%d", port),
-		WriteTimeout: timeout,
-		ReadTimeout:  timeout,
-		IdleTimeout:  timeout,
-	}
-
-	log.Printf("### 🌐 %s API, listening on port: %d", b.ServiceName, port)
-	log.Printf("### 🚀 Build details: %s (%s)", b.Version, b.BuildInfo)
-	log.Fatal(srv.ListenAndServe())
-}
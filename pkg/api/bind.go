@@ -0,0 +1,368 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Typed request binding, decodes body, form, query & path params into a struct
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+	"github.com/go-chi/chi/v5"
+)
+
+// BindOptions controls how requests are decoded by BindWith
+type BindOptions struct {
+	// Maximum size of the request body in bytes
+	MaxBodyBytes int64
+
+	// When false, fields in the body not present in the struct are rejected
+	AllowUnknownFields bool
+}
+
+// DefaultBindOptions are used by Bind, 1MB body limit and unknown fields rejected
+var DefaultBindOptions = BindOptions{
+	MaxBodyBytes: 1 << 20,
+}
+
+// Bind decodes the request into a new T and validates it, see BindWith
+func Bind[T any](r *http.Request) (T, *problem.Problem) {
+	return BindWith[T](r, DefaultBindOptions)
+}
+
+// BindWith decodes the request into a new T, then validates it using `validate` struct tags
+// - The body is decoded as JSON or a form, depending on the Content-Type
+// - Fields tagged with `query:"name"` are set from the query string
+// - Fields tagged with `path:"name"` are set from chi URL params
+// Any failure is returned as a problem ready to send, listing every invalid field
+func BindWith[T any](r *http.Request, opts BindOptions) (T, *problem.Problem) {
+	var target T
+
+	val := reflect.ValueOf(&target).Elem()
+	if val.Kind() != reflect.Struct {
+		return target, problem.Wrap(500, "request-binding", "api-internals",
+			fmt.Errorf("bind target must be a struct, got %s", val.Type()))
+	}
+
+	if err := checkTypeTags(val.Type()); err != nil {
+		return target, problem.Wrap(500, "request-binding", "api-internals", err)
+	}
+
+	if prob := bindBody(r, &target, opts); prob != nil {
+		return target, prob
+	}
+
+	invalid := []problem.InvalidParam{}
+	invalid = append(invalid, bindParams(val, "query", func(name string) []string {
+		return r.URL.Query()[name]
+	})...)
+	invalid = append(invalid, bindParams(val, "path", func(name string) []string {
+		if param := chi.URLParam(r, name); param != "" {
+			return []string{param}
+		}
+
+		return nil
+	})...)
+
+	invalid = append(invalid, Validate(target)...)
+
+	if len(invalid) > 0 {
+		return target, invalidProblem(r, invalid)
+	}
+
+	return target, nil
+}
+
+// bindBody decodes the body into the target based on the Content-Type
+func bindBody(r *http.Request, target any, opts BindOptions) *problem.Problem {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil
+	}
+
+	if opts.MaxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(nil, r.Body, opts.MaxBodyBytes)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var err error
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		err = bindForm(r, target, opts)
+	case "application/json", "":
+		err = bindJSON(r.Body, target, opts)
+	default:
+		return problem.New("unsupported-media-type", "Unsupported media type", http.StatusUnsupportedMediaType,
+			fmt.Sprintf("content type '%s' is not supported", mediaType), r.RequestURI)
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return problem.New("request-too-large", "Request body too large", http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("body must be no more than %d bytes", maxBytesErr.Limit), r.RequestURI)
+	}
+
+	var fieldErr *paramError
+	if errors.As(err, &fieldErr) {
+		return invalidProblem(r, []problem.InvalidParam{{Name: fieldErr.name, Reason: fieldErr.reason}})
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return invalidProblem(r, []problem.InvalidParam{{
+			Name:   typeErr.Field,
+			Reason: fmt.Sprintf("must be of type %s", typeErr.Type),
+		}})
+	}
+
+	if err != nil {
+		return problem.New("invalid-body", "Request body could not be decoded", http.StatusBadRequest,
+			err.Error(), r.RequestURI)
+	}
+
+	return nil
+}
+
+// bindJSON decodes a single JSON value into the target, fields bound from the path or query are left unset
+func bindJSON(body io.Reader, target any, opts BindOptions) error {
+	dec := json.NewDecoder(body)
+	if !opts.AllowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(target); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		return err
+	}
+
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return err
+		}
+
+		return errors.New("body must contain a single JSON value")
+	}
+
+	// The decoder matches fields by their Go name when there's no json tag, so it can set these
+	val := reflect.ValueOf(target).Elem()
+
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Type().Field(i)
+		if !isParamField(field) || !field.IsExported() || val.Field(i).IsZero() {
+			continue
+		}
+
+		if !opts.AllowUnknownFields {
+			return &paramError{fieldName(field), "unknown field"}
+		}
+
+		val.Field(i).SetZero()
+	}
+
+	return nil
+}
+
+// isParamField is true for fields set from the path or query string, these are never set from the body
+func isParamField(field reflect.StructField) bool {
+	_, path := field.Tag.Lookup("path")
+	_, query := field.Tag.Lookup("query")
+
+	return path || query
+}
+
+// bindForm sets fields from a url-encoded or multipart form, matched by `form` then `json` tag
+func bindForm(r *http.Request, target any, opts BindOptions) error {
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		err = r.ParseMultipartForm(opts.MaxBodyBytes)
+	} else {
+		err = r.ParseForm()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	val := reflect.ValueOf(target).Elem()
+	known := map[string]bool{}
+
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Type().Field(i)
+		name := fieldName(field, "form")
+
+		if name == "" || !field.IsExported() || isParamField(field) {
+			continue
+		}
+
+		known[name] = true
+
+		if values, ok := r.PostForm[name]; ok {
+			if err := setField(val.Field(i), values); err != nil {
+				return &paramError{name, err.Error()}
+			}
+		}
+	}
+
+	if !opts.AllowUnknownFields {
+		for name := range r.PostForm {
+			if !known[name] {
+				return &paramError{name, "unknown field"}
+			}
+		}
+	}
+
+	return nil
+}
+
+// bindParams sets any fields with the given tag using the lookup function
+func bindParams(val reflect.Value, tag string, lookup func(name string) []string) []problem.InvalidParam {
+	invalid := []problem.InvalidParam{}
+
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Type().Field(i)
+
+		name, ok := field.Tag.Lookup(tag)
+		if !ok || !field.IsExported() {
+			continue
+		}
+
+		values := lookup(name)
+		if len(values) == 0 {
+			continue
+		}
+
+		if err := setField(val.Field(i), values); err != nil {
+			invalid = append(invalid, problem.InvalidParam{Name: name, Reason: err.Error()})
+		}
+	}
+
+	return invalid
+}
+
+// setField converts string values to the type of the field and sets it
+func setField(field reflect.Value, values []string) error {
+	if field.Kind() == reflect.Pointer {
+		ptr := reflect.New(field.Type().Elem())
+		if err := setField(ptr.Elem(), values); err != nil {
+			return err
+		}
+
+		field.Set(ptr)
+
+		return nil
+	}
+
+	if tu, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		if err := tu.UnmarshalText([]byte(values[0])); err != nil {
+			return fmt.Errorf("invalid value '%s'", values[0])
+		}
+
+		return nil
+	}
+
+	if field.Kind() == reflect.Slice {
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setField(slice.Index(i), []string{value}); err != nil {
+				return err
+			}
+		}
+
+		field.Set(slice)
+
+		return nil
+	}
+
+	value := values[0]
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("must be a boolean")
+		}
+
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be a positive integer")
+		}
+
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+
+	return nil
+}
+
+// fieldName returns the name of a field from the given tag, falling back to json then the Go name
+// Returns empty string if the field is excluded with "-"
+func fieldName(field reflect.StructField, tags ...string) string {
+	for _, tag := range append(tags, "json") {
+		if value, ok := field.Tag.Lookup(tag); ok {
+			name, _, _ := strings.Cut(value, ",")
+			if name == "-" {
+				return ""
+			}
+
+			if name != "" {
+				return name
+			}
+		}
+	}
+
+	return field.Name
+}
+
+func invalidProblem(r *http.Request, invalid []problem.InvalidParam) *problem.Problem {
+	p := problem.New("request-validation", "Request validation failed", http.StatusBadRequest,
+		fmt.Sprintf("%d field(s) in the request are invalid", len(invalid)), r.RequestURI)
+	p.InvalidParams = invalid
+
+	return p
+}
+
+// paramError is a decoding error for a single named field
+type paramError struct {
+	name   string
+	reason string
+}
+
+func (e *paramError) Error() string {
+	return e.name + ": " + e.reason
+}
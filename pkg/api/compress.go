@@ -0,0 +1,326 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Response compression & decompression of request bodies
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressOptions configure CompressMiddleware
+type CompressOptions struct {
+	// Responses smaller than this are sent uncompressed, streamed responses are always compressed
+	MinSize int
+
+	// Content types to compress, entries ending in / match a whole family, e.g. "text/"
+	ContentTypes []string
+}
+
+// DefaultCompressOptions compress text based responses of 1KB or more
+var DefaultCompressOptions = CompressOptions{
+	MinSize: 1024,
+	ContentTypes: []string{
+		"text/",
+		"application/json",
+		"application/problem+json",
+		"application/x-ndjson",
+		"application/xml",
+		"application/yaml",
+		"application/javascript",
+		"image/svg+xml",
+	},
+}
+
+// Supported encodings, in order of preference when the client accepts several equally
+var compressEncodings = []string{"zstd", "gzip", "deflate"}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// zstd encoders are expensive to create, so all encoders are pooled
+var compressorPools = map[string]*sync.Pool{
+	"gzip": {New: func() any {
+		return gzip.NewWriter(io.Discard)
+	}},
+	"deflate": {New: func() any {
+		fw, _ := flate.NewWriter(io.Discard, flate.DefaultCompression)
+		return fw
+	}},
+	"zstd": {New: func() any {
+		zw, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1))
+		return zw
+	}},
+}
+
+// CompressMiddleware compresses responses with zstd, gzip or deflate, as negotiated with Accept-Encoding
+// Request bodies sent with Content-Encoding: gzip are decompressed before reaching the handler
+// Flushing is passed through, so SSE & streamed responses are sent as they are written
+func CompressMiddleware(opts CompressOptions) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !decompressRequest(w, r) {
+				return
+			}
+
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+			if encoding == "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, opts: opts, encoding: encoding, status: http.StatusOK}
+
+			// Cleared once the handler returns, if it's still set in Close the handler panicked
+			panicking := true
+			defer func() { cw.Close(panicking) }()
+
+			next.ServeHTTP(cw, r)
+			panicking = false
+		})
+	}
+}
+
+// decompressRequest swaps a gzipped request body for a decompressing reader, sending a problem if it can't
+func decompressRequest(w http.ResponseWriter, r *http.Request) bool {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+
+	switch encoding {
+	case "", "identity":
+		return true
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			problem.Wrap(http.StatusBadRequest, "bad-request", r.RequestURI,
+				fmt.Errorf("request body is not valid gzip: %w", err)).SendWithRequest(w, r)
+
+			return false
+		}
+
+		// Size limits, e.g. from Bind, apply to the decompressed body as it's read
+		r.Body = gzipBody{Reader: gr, orig: r.Body}
+		r.ContentLength = -1
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+
+		return true
+	default:
+		w.Header().Set("Accept-Encoding", "gzip")
+		problem.Wrap(http.StatusUnsupportedMediaType, "unsupported-media-type", r.RequestURI,
+			fmt.Errorf("request content encoding '%s' is not supported, use gzip", encoding)).SendWithRequest(w, r)
+
+		return false
+	}
+}
+
+type gzipBody struct {
+	*gzip.Reader
+	orig io.Closer
+}
+
+func (gb gzipBody) Close() error {
+	_ = gb.Reader.Close()
+	return gb.orig.Close()
+}
+
+// negotiateEncoding picks the best supported encoding from Accept-Encoding, or "" for none
+func negotiateEncoding(acceptEncoding string) string {
+	best := ""
+	bestQ := 0.0
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+
+		for _, enc := range compressEncodings {
+			if name != enc && name != "*" {
+				continue
+			}
+
+			// Equal q-values go to the encoding we prefer, which is earlier in the list
+			if q > bestQ || (q == bestQ && q > 0 && preference(enc) < preference(best)) {
+				best = enc
+				bestQ = q
+			}
+
+			if name != "*" {
+				break
+			}
+		}
+	}
+
+	return best
+}
+
+func preference(encoding string) int {
+	for i, enc := range compressEncodings {
+		if enc == encoding {
+			return i
+		}
+	}
+
+	return len(compressEncodings)
+}
+
+// compressWriter buffers the start of a response until it knows whether it's worth compressing
+type compressWriter struct {
+	http.ResponseWriter
+	opts     CompressOptions
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	cmp      compressor
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	// Informational responses go straight out, only the final status is held back
+	if status >= 100 && status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	cw.status = status
+}
+
+func (cw *compressWriter) Write(data []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, data...)
+		if len(cw.buf) < cw.opts.MinSize {
+			return len(data), nil
+		}
+
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	if cw.cmp != nil {
+		return cw.cmp.Write(data)
+	}
+
+	return cw.ResponseWriter.Write(data)
+}
+
+// Flush sends what's been written so far, a flushed response is always compressed if its type allows
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		_ = cw.decide(true)
+	}
+
+	if cw.cmp != nil {
+		_ = cw.cmp.Flush()
+	}
+
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Close finishes the response, sending anything still buffered
+// After a panic nothing is sent if the headers haven't been, leaving RecoverMiddleware to send its problem
+func (cw *compressWriter) Close(panicking bool) {
+	if !cw.decided {
+		if panicking {
+			cw.buf = nil
+			return
+		}
+
+		_ = cw.decide(len(cw.buf) >= cw.opts.MinSize)
+	}
+
+	if cw.cmp != nil {
+		_ = cw.cmp.Close()
+		compressorPools[cw.encoding].Put(cw.cmp)
+		cw.cmp = nil
+	}
+}
+
+// decide sends the headers, compressed or not, and writes out the buffer
+func (cw *compressWriter) decide(bigEnough bool) error {
+	cw.decided = true
+	h := cw.Header()
+
+	// Set the type now, otherwise it would be sniffed from the compressed bytes
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	compressible := cw.compressibleType(h.Get("Content-Type"))
+	if compressible {
+		h.Add("Vary", "Accept-Encoding")
+	}
+
+	if !compressible || !bigEnough || h.Get("Content-Encoding") != "" ||
+		cw.status == http.StatusNoContent || cw.status == http.StatusNotModified {
+		cw.ResponseWriter.WriteHeader(cw.status)
+		_, err := cw.ResponseWriter.Write(cw.buf)
+		cw.buf = nil
+
+		return err
+	}
+
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+
+	// The compressed bytes differ from what the ETag was computed on, so the tag is marked with the encoding
+	// etagMatches removes the mark, so the tag still works with If-Match & If-None-Match
+	if etag := h.Get("ETag"); strings.HasSuffix(etag, `"`) {
+		h.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+cw.encoding+`"`)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	cw.cmp, _ = compressorPools[cw.encoding].Get().(compressor)
+	cw.cmp.Reset(cw.ResponseWriter)
+
+	_, err := cw.cmp.Write(cw.buf)
+	cw.buf = nil
+
+	return err
+}
+
+func (cw *compressWriter) compressibleType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	for _, allowed := range cw.opts.ContentTypes {
+		if mediaType == allowed || (strings.HasSuffix(allowed, "/") && strings.HasPrefix(mediaType, allowed)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,321 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Policy driven CORS, with origin allow-lists and per route group policies
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benc-uk/go-rest-api/pkg/env"
+)
+
+// CORSPolicy is which cross origin requests are allowed, and what they can see of the response
+type CORSPolicy struct {
+	// Origins allowed, exact e.g. "https://app.example.com", a wildcard subdomain e.g. "https://*.example.com",
+	// or "*" for any origin, which can't be used with AllowCredentials
+	AllowedOrigins []string
+
+	// Regular expressions matched against the whole origin
+	AllowedOriginPatterns []string
+
+	// Methods allowed, defaults to GET, HEAD & POST
+	AllowedMethods []string
+
+	// Request headers allowed, "*" allows any, defaults to Accept, Authorization, Content-Type & X-Request-ID
+	AllowedHeaders []string
+
+	// Response headers, beyond the simple ones, that scripts can read
+	ExposedHeaders []string
+
+	// Allow cookies & TLS client certificates to be sent
+	AllowCredentials bool
+
+	// How long browsers can cache a preflight response, zero leaves it to the browser
+	MaxAge time.Duration
+}
+
+// Default methods & headers allowed when a policy doesn't set them
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	defaultCORSHeaders = []string{"Accept", "Authorization", "Content-Type", "X-Request-ID"}
+)
+
+// CORSPolicyFromEnv reads a policy from environment variables starting with the prefix, e.g. CORS_ALLOWED_ORIGINS
+// Lists are comma separated: _ALLOWED_ORIGINS, _ALLOWED_ORIGIN_PATTERNS, _ALLOWED_METHODS, _ALLOWED_HEADERS
+// & _EXPOSED_HEADERS. _ALLOW_CREDENTIALS is a boolean and _MAX_AGE in seconds, unset variables use the defaults
+func CORSPolicyFromEnv(prefix string, defaults CORSPolicy) CORSPolicy {
+	return CORSPolicy{
+		AllowedOrigins:        env.GetEnvList(prefix+"_ALLOWED_ORIGINS", defaults.AllowedOrigins),
+		AllowedOriginPatterns: env.GetEnvList(prefix+"_ALLOWED_ORIGIN_PATTERNS", defaults.AllowedOriginPatterns),
+		AllowedMethods:        env.GetEnvList(prefix+"_ALLOWED_METHODS", defaults.AllowedMethods),
+		AllowedHeaders:        env.GetEnvList(prefix+"_ALLOWED_HEADERS", defaults.AllowedHeaders),
+		ExposedHeaders:        env.GetEnvList(prefix+"_EXPOSED_HEADERS", defaults.ExposedHeaders),
+		AllowCredentials:      env.GetEnvBool(prefix+"_ALLOW_CREDENTIALS", defaults.AllowCredentials),
+		MaxAge:                time.Duration(env.GetEnvInt(prefix+"_MAX_AGE", int(defaults.MaxAge.Seconds()))) * time.Second,
+	}
+}
+
+// CORS applies a default policy, and policies for groups of routes, see NewCORS
+type CORS struct {
+	defaultPolicy *corsPolicy
+	groups        []corsGroup
+}
+
+type corsGroup struct {
+	prefix string
+	policy *corsPolicy
+}
+
+// corsPolicy is a CORSPolicy checked & ready to use
+type corsPolicy struct {
+	anyOrigin   bool
+	origins     []string
+	wildcards   [][2]string
+	patterns    []*regexp.Regexp
+	methods     []string
+	headers     []string
+	anyHeader   bool
+	credentials bool
+
+	// Header values, worked out once
+	allowMethods  string
+	exposeHeaders string
+	maxAge        string
+}
+
+// NewCORS creates CORS middleware with a default policy, an error is returned when the policy is invalid
+func NewCORS(policy CORSPolicy) (*CORS, error) {
+	p, err := newCORSPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CORS{defaultPolicy: p}, nil
+}
+
+// Group sets a different policy for routes under a path prefix, e.g. "/admin", the longest matching prefix is used
+// Groups are matched on the path rather than from chi route groups, as preflight requests don't match any route
+func (c *CORS) Group(prefix string, policy CORSPolicy) error {
+	p, err := newCORSPolicy(policy)
+	if err != nil {
+		return fmt.Errorf("CORS policy for %s: %w", prefix, err)
+	}
+
+	c.groups = append(c.groups, corsGroup{prefix: "/" + strings.Trim(prefix, "/"), policy: p})
+
+	// Longest first, so the most specific group wins
+	slices.SortStableFunc(c.groups, func(a, b corsGroup) int {
+		return len(b.prefix) - len(a.prefix)
+	})
+
+	return nil
+}
+
+// Middleware answers preflight requests and adds CORS headers to the responses of allowed origins
+// Rejected preflights are logged with the reason and sent no CORS headers, so the browser blocks the request
+// Use it on the top level router before any middleware that rejects requests, so browsers can read those errors
+func (c *CORS) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		policy := c.policyFor(r.URL.Path)
+		h := w.Header()
+
+		// Responses depend on the origin, caches must not share them between origins
+		h.Add("Vary", "Origin")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+
+			if err := policy.checkPreflight(origin, r); err != nil {
+				log.Printf("### 🚫 CORS: rejected preflight from '%s' for %s %s: %s",
+					origin, r.Header.Get("Access-Control-Request-Method"), r.URL.Path, err)
+
+				w.WriteHeader(http.StatusNoContent)
+
+				return
+			}
+
+			policy.setOriginHeaders(h, origin)
+			h.Set("Access-Control-Allow-Methods", policy.allowMethods)
+
+			if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+				h.Set("Access-Control-Allow-Headers", reqHeaders)
+			}
+
+			if policy.maxAge != "" {
+				h.Set("Access-Control-Max-Age", policy.maxAge)
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+
+			return
+		}
+
+		if policy.originAllowed(origin) {
+			policy.setOriginHeaders(h, origin)
+
+			if policy.exposeHeaders != "" {
+				h.Set("Access-Control-Expose-Headers", policy.exposeHeaders)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *CORS) policyFor(path string) *corsPolicy {
+	for _, group := range c.groups {
+		if path == group.prefix || strings.HasPrefix(path, strings.TrimSuffix(group.prefix, "/")+"/") {
+			return group.policy
+		}
+	}
+
+	return c.defaultPolicy
+}
+
+func newCORSPolicy(policy CORSPolicy) (*corsPolicy, error) {
+	p := &corsPolicy{
+		methods:     slices.Clone(policy.AllowedMethods),
+		headers:     slices.Clone(policy.AllowedHeaders),
+		credentials: policy.AllowCredentials,
+	}
+
+	for _, origin := range policy.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+
+		switch strings.Count(origin, "*") {
+		case 0:
+			p.origins = append(p.origins, origin)
+		case 1:
+			if origin == "*" {
+				p.anyOrigin = true
+				continue
+			}
+
+			scheme, host, ok := strings.Cut(origin, "://")
+			if !ok || !strings.HasPrefix(host, "*.") {
+				return nil, fmt.Errorf("wildcard origin '%s' must be a subdomain, e.g. https://*.example.com", origin)
+			}
+
+			p.wildcards = append(p.wildcards, [2]string{scheme + "://", host[1:]})
+		default:
+			return nil, fmt.Errorf("origin '%s' can only have one wildcard", origin)
+		}
+	}
+
+	for _, pattern := range policy.AllowedOriginPatterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("origin pattern '%s': %w", pattern, err)
+		}
+
+		p.patterns = append(p.patterns, re)
+	}
+
+	if p.anyOrigin && p.credentials {
+		return nil, errors.New("credentials can't be allowed from any origin, list the origins instead")
+	}
+
+	if len(p.methods) == 0 {
+		p.methods = slices.Clone(defaultCORSMethods)
+	}
+
+	if len(p.headers) == 0 {
+		p.headers = defaultCORSHeaders
+	}
+
+	for i, method := range p.methods {
+		p.methods[i] = strings.ToUpper(method)
+	}
+
+	p.anyHeader = slices.Contains(p.headers, "*")
+	p.allowMethods = strings.Join(p.methods, ", ")
+	p.exposeHeaders = strings.Join(policy.ExposedHeaders, ", ")
+
+	if policy.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(policy.MaxAge.Seconds()))
+	}
+
+	return p, nil
+}
+
+func (p *corsPolicy) originAllowed(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+
+	if slices.Contains(p.origins, origin) {
+		return true
+	}
+
+	for _, wc := range p.wildcards {
+		sub, ok := strings.CutPrefix(origin, wc[0])
+		if ok && strings.HasSuffix(sub, wc[1]) && len(sub) > len(wc[1]) && !strings.ContainsAny(sub, "/@") {
+			return true
+		}
+	}
+
+	for _, re := range p.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPreflight returns why a preflight request isn't allowed, or nil when it is
+func (p *corsPolicy) checkPreflight(origin string, r *http.Request) error {
+	if !p.originAllowed(origin) {
+		return errors.New("origin not allowed")
+	}
+
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	if !slices.Contains(p.methods, method) {
+		return fmt.Errorf("method %s not allowed, use one of: %s", method, p.allowMethods)
+	}
+
+	if p.anyHeader {
+		return nil
+	}
+
+	for _, header := range splitList(r.Header.Get("Access-Control-Request-Headers")) {
+		if !slices.ContainsFunc(p.headers, func(allowed string) bool { return strings.EqualFold(allowed, header) }) {
+			return fmt.Errorf("header %s not allowed", header)
+		}
+	}
+
+	return nil
+}
+
+func (p *corsPolicy) setOriginHeaders(h http.Header, origin string) {
+	if p.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
@@ -0,0 +1,259 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Standard response encoders; JSON, XML, YAML, CSV & MessagePack
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// registerDefaultEncoders adds the standard encoders, JSON is first so it's the default
+func (b *Base) registerDefaultEncoders() {
+	b.RegisterEncoder("application/json", EncodeJSON)
+	b.RegisterEncoder("application/xml", EncodeXML)
+	b.RegisterEncoder("text/xml", EncodeXML)
+	b.RegisterEncoder("application/yaml", EncodeYAML)
+	b.RegisterEncoder("text/csv", EncodeCSV)
+	b.RegisterEncoder("application/msgpack", EncodeMsgPack)
+	b.RegisterEncoder("application/x-msgpack", EncodeMsgPack)
+}
+
+// EncodeJSON encodes data as JSON
+func EncodeJSON(w io.Writer, data any) error {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(dataBytes)
+
+	return err
+}
+
+// EncodeXML encodes data as XML, slices are wrapped in an <items> root element
+// For a PageEnvelope only the items are encoded, the links are still sent in the Link header
+func EncodeXML(w io.Writer, data any) error {
+	data = unwrapEnvelope(data)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	val := reflect.Indirect(reflect.ValueOf(data))
+
+	var err error
+
+	if (val.Kind() == reflect.Slice || val.Kind() == reflect.Array) && val.Type().Elem().Kind() != reflect.Uint8 {
+		root := xml.StartElement{Name: xml.Name{Local: "items"}}
+		err = enc.EncodeToken(root)
+
+		for i := 0; err == nil && i < val.Len(); i++ {
+			err = enc.Encode(val.Index(i).Interface())
+		}
+
+		if err == nil {
+			err = enc.EncodeToken(root.End())
+		}
+	} else {
+		err = enc.Encode(data)
+	}
+
+	var unsupported *xml.UnsupportedTypeError
+	if errors.As(err, &unsupported) {
+		return fmt.Errorf("%w: %s", ErrNotEncodable, err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return enc.Flush()
+}
+
+// EncodeYAML encodes data as YAML
+// The data goes via JSON first, so json struct tags are honoured & the output matches the JSON
+func EncodeYAML(w io.Writer, data any) error {
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	// JSON is valid YAML, decoding into a node keeps the field order
+	node := yaml.Node{}
+	if err := yaml.Unmarshal(jsonBytes, &node); err != nil {
+		return err
+	}
+
+	blockStyle(&node)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(&node); err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
+
+// blockStyle clears the flow & quoting styles from JSON, so the output is idiomatic YAML
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// EncodeMsgPack encodes data as MessagePack, using json struct tags for field names
+func EncodeMsgPack(w io.Writer, data any) error {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+
+	return enc.Encode(data)
+}
+
+// EncodeCSV encodes a struct or slice of structs as CSV, with a header row of field names
+// Fields are named by their json tags, nested values are written as JSON
+// For a PageEnvelope only the items are encoded, the links are still sent in the Link header
+func EncodeCSV(w io.Writer, data any) error {
+	data = unwrapEnvelope(data)
+
+	val := reflect.Indirect(reflect.ValueOf(data))
+	if !val.IsValid() {
+		return fmt.Errorf("%w: CSV can not encode nil", ErrNotEncodable)
+	}
+
+	rows := []reflect.Value{}
+
+	switch val.Kind() {
+	case reflect.Struct:
+		rows = append(rows, val)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < val.Len(); i++ {
+			rows = append(rows, reflect.Indirect(val.Index(i)))
+		}
+	}
+
+	elemType := val.Type()
+	if val.Kind() == reflect.Slice || val.Kind() == reflect.Array {
+		elemType = elemType.Elem()
+		if elemType.Kind() == reflect.Pointer {
+			elemType = elemType.Elem()
+		}
+	}
+
+	if elemType.Kind() != reflect.Struct {
+		return fmt.Errorf("%w: CSV requires a struct or slice of structs", ErrNotEncodable)
+	}
+
+	fields, names := csvFields(elemType)
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write(names); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		record := make([]string, len(fields))
+
+		for i, field := range fields {
+			if !row.IsValid() {
+				continue
+			}
+
+			cell, err := csvCell(row.Field(field))
+			if err != nil {
+				return err
+			}
+
+			record[i] = cell
+		}
+
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// csvFields returns the indexes & column names of the exported fields of a struct
+func csvFields(t reflect.Type) ([]int, []string) {
+	fields := []int{}
+	names := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			tagName, _, _ := strings.Cut(tag, ",")
+			if tagName == "-" {
+				continue
+			}
+
+			if tagName != "" {
+				name = tagName
+			}
+		}
+
+		fields = append(fields, i)
+		names = append(names, name)
+	}
+
+	return fields, names
+}
+
+// csvCell converts a single field value into a string
+func csvCell(val reflect.Value) (string, error) {
+	if val.Kind() == reflect.Pointer || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return "", nil
+		}
+	}
+
+	if tm, ok := val.Interface().(encoding.TextMarshaler); ok {
+		text, err := tm.MarshalText()
+		return string(text), err
+	}
+
+	switch reflect.Indirect(val).Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		jsonBytes, err := json.Marshal(val.Interface())
+		return string(jsonBytes), err
+	default:
+		return fmt.Sprint(reflect.Indirect(val).Interface()), nil
+	}
+}
+
+// unwrapEnvelope returns the items of an envelope, other data is returned as is
+func unwrapEnvelope(data any) any {
+	if env, ok := data.(envelope); ok {
+		return env.unwrapItems()
+	}
+
+	return data
+}
@@ -14,8 +14,7 @@ import (
 
 	"github.com/elastic/go-sysinfo"
 	"github.com/go-chi/chi/v5"
-	metrics "github.com/m8as/go-chi-metrics"
-
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -32,12 +31,20 @@ type Status struct {
 	ClientAddr   string `json:"clientAddr"`
 	ServerHost   string `json:"serverHost"`
 	Uptime       string `json:"uptime"`
+
+	Health HealthState `json:"health"`
+	TLS    *TLSStatus  `json:"tls,omitempty"`
 }
 
 // AddOKEndpoint adds an endpoint that respond 200 when hitting it
 func (b *Base) AddOKEndpoint(r chi.Router, path string) {
 	log.Printf("### 🍏 API: 200 OK endpoint at: %s", "/"+path)
 
+	b.Document(http.MethodGet, "/"+path).
+		Describe("Always returns 200 OK", "").
+		Tag("operations").
+		Returns(http.StatusOK, "OK", "", "text/plain")
+
 	r.Get("/"+path, func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		b.ReturnText(w, "OK")
@@ -45,30 +52,53 @@ func (b *Base) AddOKEndpoint(r chi.Router, path string) {
 }
 
 // AddMetrics adds Prometheus metrics to the router
+// When using an admin server, also add MetricsMiddleware to the main router so API requests are measured
 func (b *Base) AddMetricsEndpoint(r chi.Router, path string) {
 	log.Printf("### 🔬 API: metrics endpoint at: %s", "/"+path)
 
-	r.Use(metrics.SetRequestDuration)
-	r.Use(metrics.IncRequestCount)
-	r.Handle("/"+path, promhttp.Handler())
+	r.Use(b.MetricsMiddleware)
+
+	// OpenMetrics is needed for the trace ID exemplars to be included, it's used when the scraper asks for it
+	r.Handle("/"+path, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
 }
 
 // AddHealth adds a health check endpoint to the API
-// preCheck is an optional function that can be used to perform a pre-check to set the Healthy status.
+// preCheck is an optional function that can be used to perform a pre-check to set the health state.
+// A degraded service still returns 200, only an unhealthy one returns 503
 func (b *Base) AddHealthEndpoint(r chi.Router, path string, preCheck func() bool) {
 	log.Printf("### 💚 API: health endpoint at: %s", "/"+path)
 
+	b.Document(http.MethodGet, "/"+path).
+		Describe("Service health check", "Returns 200 when healthy or degraded, 503 when unhealthy").
+		Tag("operations").
+		Returns(http.StatusOK, "Service is healthy or degraded", "", "text/plain").
+		Returns(http.StatusServiceUnavailable, "Service is not healthy", "", "text/plain")
+
 	r.HandleFunc("/"+path, func(w http.ResponseWriter, r *http.Request) {
 		if preCheck != nil {
-			b.Healthy = preCheck()
+			if preCheck() {
+				// Only recover from unhealthy, a degraded state is left for whatever set it to clear
+				if b.Health().Level == Unhealthy {
+					b.SetHealth(Healthy, "")
+				}
+			} else {
+				b.SetHealth(Unhealthy, "health pre-check failed")
+			}
 		}
 
-		if b.Healthy {
+		state := b.Health()
+
+		switch state.Level {
+		case Healthy:
 			w.WriteHeader(http.StatusOK)
 			b.ReturnText(w, "OK: Service is healthy")
-		} else {
+		case Degraded:
+			w.WriteHeader(http.StatusOK)
+			b.ReturnText(w, "OK: Service is degraded"+reasonSuffix(state.Reason))
+		default:
 			w.WriteHeader(http.StatusServiceUnavailable)
-			b.ReturnText(w, "Error: Service is not healthy")
+			b.ReturnText(w, "Error: Service is not healthy"+reasonSuffix(state.Reason))
 		}
 	})
 }
@@ -77,13 +107,20 @@ func (b *Base) AddHealthEndpoint(r chi.Router, path string, preCheck func() bool
 func (b *Base) AddStatusEndpoint(r chi.Router, path string) {
 	log.Printf("### 🔮 API: status endpoint at: %s", "/"+path)
 
+	b.Document(http.MethodGet, "/"+path).
+		Describe("Service status & info", "").
+		Tag("operations").
+		Returns(http.StatusOK, "Status of the service", Status{}, "application/json")
+
 	r.HandleFunc("/"+path, func(w http.ResponseWriter, r *http.Request) {
 		host, _ := sysinfo.Host()
 		host.Info().Uptime()
 
+		health := b.Health()
+
 		status := Status{
 			Service:      b.ServiceName,
-			Healthy:      b.Healthy,
+			Healthy:      health.Level != Unhealthy,
 			Version:      b.Version,
 			BuildInfo:    b.BuildInfo,
 			Hostname:     host.Info().Hostname,
@@ -94,6 +131,8 @@ func (b *Base) AddStatusEndpoint(r chi.Router, path string) {
 			ClientAddr:   r.RemoteAddr,
 			ServerHost:   r.Host,
 			Uptime:       host.Info().Uptime().String(),
+			Health:       health,
+			TLS:          b.TLSStatus(),
 		}
 
 		b.ReturnJSON(w, status)
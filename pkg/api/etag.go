@@ -0,0 +1,244 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// ETags and conditional requests, see RFC 9110 section 13
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+)
+
+// ResourceState returns the current ETag & last modified time of the resource a request targets
+// Either can be empty or zero if not tracked, both empty means the resource doesn't exist
+type ResourceState func(r *http.Request) (etag string, lastModified time.Time, err error)
+
+// ETag returns a strong entity tag for a response body, a quoted hash of the content
+func ETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+}
+
+// WeakETag returns a weak entity tag for a response body, for bodies that are equivalent but not byte identical
+func WeakETag(body []byte) string {
+	return "W/" + ETag(body)
+}
+
+// ETagMiddleware adds an ETag to successful GET & HEAD responses, hashing the body when the handler hasn't set one
+// Clients sending a matching If-None-Match get a 304 Not Modified with no body
+// Responses that are flushed, e.g. SSE streams, are passed through untouched
+func ETagMiddleware(weak bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rec := &etagRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			if rec.streaming {
+				return
+			}
+
+			if rec.status == http.StatusOK && w.Header().Get("ETag") == "" {
+				if weak {
+					w.Header().Set("ETag", WeakETag(rec.buf.Bytes()))
+				} else {
+					w.Header().Set("ETag", ETag(rec.buf.Bytes()))
+				}
+			}
+
+			if rec.status == http.StatusOK && notModified(w, r) {
+				return
+			}
+
+			w.WriteHeader(rec.status)
+			_, _ = w.Write(rec.buf.Bytes())
+		})
+	}
+}
+
+// CheckPreconditions enforces If-Match, If-Unmodified-Since and If-None-Match on a mutating request
+// Pass the current ETag & last modified time of the resource, a 412 problem is returned when a precondition fails
+func CheckPreconditions(r *http.Request, etag string, lastModified time.Time) *problem.Problem {
+	exists := etag != "" || !lastModified.IsZero()
+
+	// If-Unmodified-Since is ignored when If-Match is sent
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !exists || !etagMatches(ifMatch, etag, false) {
+			return preconditionFailed(r, fmt.Sprintf("If-Match '%s' does not match the current ETag", ifMatch))
+		}
+	} else if since := r.Header.Get("If-Unmodified-Since"); since != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(since)
+		if err == nil && lastModified.Truncate(time.Second).After(t) {
+			return preconditionFailed(r, fmt.Sprintf("resource has been modified since %s", since))
+		}
+	}
+
+	// If-None-Match: * on a PUT or POST means only create when the resource doesn't exist yet
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && exists && etagMatches(ifNoneMatch, etag, true) {
+		return preconditionFailed(r, fmt.Sprintf("If-None-Match '%s' matches the current resource", ifNoneMatch))
+	}
+
+	return nil
+}
+
+// RequirePreconditions checks the conditional headers of POST, PUT, PATCH & DELETE requests against the resource state
+// When required is true, requests without If-Match or If-Unmodified-Since are sent 428 Precondition Required,
+// this stops lost updates from clients that didn't fetch the resource first
+func RequirePreconditions(state ResourceState, required bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+			default:
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if required && r.Header.Get("If-Match") == "" && r.Header.Get("If-Unmodified-Since") == "" {
+				problem.New(problemType(http.StatusPreconditionRequired), http.StatusText(http.StatusPreconditionRequired),
+					http.StatusPreconditionRequired, "this request must be conditional, send If-Match or If-Unmodified-Since",
+					r.RequestURI).SendWithRequest(w, r)
+
+				return
+			}
+
+			etag, lastModified, err := state(r)
+			if err != nil {
+				errorProblem(r, err).SendWithRequest(w, r)
+				return
+			}
+
+			if prob := CheckPreconditions(r, etag, lastModified); prob != nil {
+				prob.SendWithRequest(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// notModified sends a 304 if the If-None-Match header of a GET or HEAD matches the ETag set on the response
+func notModified(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	etag := w.Header().Get("ETag")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+
+	if etag == "" || ifNoneMatch == "" || !etagMatches(ifNoneMatch, etag, true) {
+		return false
+	}
+
+	// A 304 has no body so these no longer apply
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+
+	return true
+}
+
+// etagMatches checks an ETag against a list from If-Match or If-None-Match
+// Weak comparison ignores the W/ prefix, strong comparison never matches weak tags
+// Tags from compressed responses match the uncompressed tag, see withoutEncoding
+func etagMatches(header, etag string, weakCompare bool) bool {
+	etag = withoutEncoding(etag)
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = withoutEncoding(strings.TrimSpace(candidate))
+
+		if candidate == "*" {
+			return true
+		}
+
+		if weakCompare {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+
+			continue
+		}
+
+		if candidate == etag && !strings.HasPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withoutEncoding removes the content encoding CompressMiddleware adds to ETags, "abc-gzip" becomes "abc"
+func withoutEncoding(etag string) string {
+	for _, enc := range compressEncodings {
+		if trimmed, ok := strings.CutSuffix(etag, "-"+enc+`"`); ok {
+			return trimmed + `"`
+		}
+	}
+
+	return etag
+}
+
+func preconditionFailed(r *http.Request, detail string) *problem.Problem {
+	return problem.New(problemType(http.StatusPreconditionFailed), http.StatusText(http.StatusPreconditionFailed),
+		http.StatusPreconditionFailed, detail, r.RequestURI)
+}
+
+// etagRecorder buffers a response so it can be hashed, unless it's flushed when it switches to passing through
+type etagRecorder struct {
+	http.ResponseWriter
+	buf         bytes.Buffer
+	status      int
+	wroteHeader bool
+	streaming   bool
+}
+
+func (er *etagRecorder) WriteHeader(status int) {
+	if er.streaming {
+		er.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if !er.wroteHeader {
+		er.status = status
+		er.wroteHeader = true
+	}
+}
+
+func (er *etagRecorder) Write(data []byte) (int, error) {
+	if er.streaming {
+		return er.ResponseWriter.Write(data)
+	}
+
+	return er.buf.Write(data)
+}
+
+// Flush switches to streaming, sending anything buffered so far
+func (er *etagRecorder) Flush() {
+	if !er.streaming {
+		er.streaming = true
+		er.ResponseWriter.WriteHeader(er.status)
+		_, _ = er.ResponseWriter.Write(er.buf.Bytes())
+		er.buf.Reset()
+	}
+
+	_ = http.NewResponseController(er.ResponseWriter).Flush()
+}
+
+func (er *etagRecorder) Unwrap() http.ResponseWriter {
+	return er.ResponseWriter
+}
@@ -0,0 +1,172 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Sparse fieldsets, pruning JSON responses to the fields asked for
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// fieldsWriter carries the selected fields from QuerySpec.Middleware to ReturnJSON & Respond
+type fieldsWriter struct {
+	http.ResponseWriter
+	fields []string
+}
+
+func (fw *fieldsWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
+
+// envelope is implemented by wrappers such as PageEnvelope, fields are selected from the items inside it
+type envelope interface {
+	// Name of the JSON member holding the items
+	envelopeItems() string
+
+	// The items, formats that can only represent a list, e.g. CSV, encode these rather than the envelope
+	unwrapItems() any
+}
+
+// selectedFields finds the fields selected for this response, looking through any wrapping writers
+func selectedFields(w http.ResponseWriter) []string {
+	for w != nil {
+		if fw, ok := w.(*fieldsWriter); ok {
+			return fw.fields
+		}
+
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+
+		w = unwrapper.Unwrap()
+	}
+
+	return nil
+}
+
+// pruneFields cuts encoded JSON down to the selected fields, keeping them in the order they were asked for
+// Arrays are pruned per element, and for envelopes only the items are pruned
+func pruneFields(data any, encoded []byte, fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		return encoded, nil
+	}
+
+	if env, ok := data.(envelope); ok {
+		keys, values, err := decodeObject(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		items := env.envelopeItems()
+
+		pruned, err := pruneValue(values[items], fields)
+		if err != nil {
+			return nil, err
+		}
+
+		values[items] = pruned
+
+		return encodeObject(keys, values), nil
+	}
+
+	return pruneValue(encoded, fields)
+}
+
+func pruneValue(raw json.RawMessage, fields []string) (json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(raw)
+
+	switch {
+	case len(trimmed) > 0 && trimmed[0] == '[':
+		elems := []json.RawMessage{}
+		if err := json.Unmarshal(trimmed, &elems); err != nil {
+			return nil, err
+		}
+
+		for i, elem := range elems {
+			pruned, err := pruneValue(elem, fields)
+			if err != nil {
+				return nil, err
+			}
+
+			elems[i] = pruned
+		}
+
+		return json.Marshal(elems)
+	case len(trimmed) > 0 && trimmed[0] == '{':
+		_, values, err := decodeObject(trimmed)
+		if err != nil {
+			return nil, err
+		}
+
+		return encodeObject(fields, values), nil
+	}
+
+	// Scalars have no fields to select
+	return raw, nil
+}
+
+// decodeObject splits a JSON object into its keys, in order, and raw values
+func decodeObject(raw []byte) ([]string, map[string]json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := dec.Token(); err != nil {
+		return nil, nil, err
+	}
+
+	keys := []string{}
+	values := map[string]json.RawMessage{}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key, _ := tok.(string)
+
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+
+		keys = append(keys, key)
+		values[key] = value
+	}
+
+	return keys, values, nil
+}
+
+// encodeObject writes the given keys as a JSON object, skipping any that have no value
+func encodeObject(keys []string, values map[string]json.RawMessage) []byte {
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+
+	written := 0
+
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+
+		if written > 0 {
+			buf.WriteByte(',')
+		}
+
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+
+		written++
+	}
+
+	buf.WriteByte('}')
+
+	return buf.Bytes()
+}
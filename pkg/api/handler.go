@@ -0,0 +1,202 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Generic typed handler adapter, removes the decode/encode/error boilerplate
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+	"github.com/benc-uk/go-rest-api/pkg/requestid"
+	"github.com/go-chi/chi/v5"
+)
+
+// Errors that typed handlers can return, or wrap, to select the problem status code
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+)
+
+// Checked in order, so an error wrapping more than one always gets the same status
+var errorStatuses = []struct {
+	err    error
+	status int
+}{
+	{ErrBadRequest, http.StatusBadRequest},
+	{ErrUnauthorized, http.StatusUnauthorized},
+	{ErrForbidden, http.StatusForbidden},
+	{ErrNotFound, http.StatusNotFound},
+	{ErrConflict, http.StatusConflict},
+	{context.DeadlineExceeded, http.StatusGatewayTimeout},
+}
+
+// TypedHandler is a handler that takes a decoded request and returns a response or error
+type TypedHandler[Req any, Resp any] func(ctx context.Context, in Req) (Resp, error)
+
+// NoContent can be used as the response type of handlers that return nothing, a 204 is sent
+type NoContent struct{}
+
+// StatusCoder can be implemented by response types to pick their own status code
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// HeaderSetter can be implemented by response types to add headers to the response
+type HeaderSetter interface {
+	SetHeaders(h http.Header)
+}
+
+type requestKey struct{}
+
+// RequestFrom returns the HTTP request from the context passed to a typed handler
+// This is an escape hatch for things not covered by binding, e.g. parsing pagination
+func RequestFrom(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(requestKey{}).(*http.Request)
+	return r
+}
+
+// Handle registers a typed handler on the router, see Adapt
+// The route is added to the OpenAPI document, the returned operation can be used to describe it further
+// It panics if the `validate` tags of the request type are invalid, see CheckValidateTags
+func Handle[Req any, Resp any](b *Base, r chi.Router, method string, pattern string,
+	h TypedHandler[Req, Resp]) *Operation {
+	if err := CheckValidateTags(*new(Req)); err != nil {
+		panic(fmt.Sprintf("%s %s: %s", method, pattern, err))
+	}
+
+	r.Method(method, pattern, Adapt(b, h))
+
+	op := b.Document(method, pattern).Accepts(*new(Req))
+
+	var resp Resp
+	if _, ok := any(resp).(NoContent); ok {
+		op.Returns(http.StatusNoContent, "", nil)
+	} else {
+		op.Returns(successStatus(method), "", resp)
+	}
+
+	return op
+}
+
+// Adapt converts a typed handler into a http.HandlerFunc
+// - The request is decoded & validated with Bind, failures are sent as problems
+// - The response is sent with Respond, so is content negotiated
+// - Status is 204 for NoContent or nil, 201 for POST, otherwise 200, unless the response is a StatusCoder
+// - Returned errors are sent as problems, wrap the Err* errors in this package or return a *problem.Problem
+func Adapt[Req any, Resp any](b *Base, h TypedHandler[Req, Resp]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		in, prob := Bind[Req](r)
+		if prob != nil {
+			prob.SendWithRequest(w, r)
+			return
+		}
+
+		out, err := h(context.WithValue(r.Context(), requestKey{}, r), in)
+		if err != nil {
+			errorProblem(r, err).SendWithRequest(w, r)
+			return
+		}
+
+		if hs, ok := any(out).(HeaderSetter); ok {
+			hs.SetHeaders(w.Header())
+		}
+
+		status := responseStatus(r, out)
+		if status == http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+
+		b.RespondStatus(w, r, status, out)
+	}
+}
+
+// responseStatus picks the success status code for a response
+func responseStatus(r *http.Request, out any) int {
+	if sc, ok := out.(StatusCoder); ok {
+		return sc.StatusCode()
+	}
+
+	if _, ok := out.(NoContent); ok {
+		return http.StatusNoContent
+	}
+
+	val := reflect.ValueOf(out)
+	if !val.IsValid() || (val.Kind() == reflect.Pointer && val.IsNil()) {
+		return http.StatusNoContent
+	}
+
+	return successStatus(r.Method)
+}
+
+// successStatus is 201 for POST as something was created, otherwise 200
+func successStatus(method string) int {
+	if method == http.MethodPost {
+		return http.StatusCreated
+	}
+
+	return http.StatusOK
+}
+
+// errorProblem maps an error returned from a handler to a problem
+// Server errors are logged and sent with a generic detail, as the error could leak internal details
+func errorProblem(r *http.Request, err error) *problem.Problem {
+	var prob *problem.Problem
+	if errors.As(err, &prob) {
+		// Handlers may return a shared problem, so the gaps are filled in on a copy
+		cp := *prob
+
+		if cp.Status == 0 {
+			cp.Status = http.StatusInternalServerError
+		}
+
+		if cp.Title == "" {
+			cp.Title = http.StatusText(cp.Status)
+		}
+
+		if cp.Instance == "" {
+			cp.Instance = r.RequestURI
+		}
+
+		return &cp
+	}
+
+	status := http.StatusInternalServerError
+	detail := "an unexpected error occurred handling the request"
+
+	for _, es := range errorStatuses {
+		if errors.Is(err, es.err) {
+			status = es.status
+			detail = es.err.Error()
+
+			break
+		}
+	}
+
+	if status >= http.StatusInternalServerError {
+		log.Printf("### 💥 API, error handling %s %s [request %s]: %s",
+			r.Method, r.URL.Path, requestid.FromContext(r.Context()), err)
+	} else {
+		detail = err.Error()
+	}
+
+	return problem.New(problemType(status), http.StatusText(status), status, detail, r.RequestURI)
+}
+
+// problemType turns a status code into a problem type, e.g. 404 -> "not-found"
+func problemType(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "-")
+}
@@ -0,0 +1,294 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Registry of named health checks, exposed as liveness, readiness & startup probes
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// DefaultCheckTimeout is used for health checks that don't set a timeout
+const DefaultCheckTimeout = 5 * time.Second
+
+// Probe is a bit set of the Kubernetes style probes a health check is part of
+type Probe int
+
+const (
+	LivenessProbe Probe = 1 << iota
+	ReadinessProbe
+	StartupProbe
+)
+
+// HealthCheck is a named check of something the service depends on, e.g. a database or Dapr sidecar
+type HealthCheck struct {
+	// Name of the check, shown in verbose probe output
+	Name string
+
+	// Check returns an error when the dependency is not healthy, it must respect the context deadline
+	Check func(ctx context.Context) error
+
+	// Probes this check is part of, defaults to ReadinessProbe
+	Probes Probe
+
+	// Max time the check can run for, defaults to DefaultCheckTimeout
+	Timeout time.Duration
+
+	// A failing critical check fails the probe, non-critical checks are reported but ignored
+	Critical bool
+
+	// How long a result is cached before the check is run again, zero means no caching
+	CacheTTL time.Duration
+}
+
+// CheckResult is the outcome of running a single health check
+type CheckResult struct {
+	Name     string `json:"name"`
+	Healthy  bool   `json:"healthy"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+	Cached   bool   `json:"cached"`
+
+	checkedAt time.Time
+}
+
+// ProbeResult is the outcome of a probe, returned as JSON when ?verbose is passed
+type ProbeResult struct {
+	Probe   string        `json:"probe"`
+	Healthy bool          `json:"healthy"`
+	Checks  []CheckResult `json:"checks"`
+}
+
+// healthRegistry holds all registered checks and their cached results
+type healthRegistry struct {
+	sync.Mutex
+	checks  []HealthCheck
+	results map[string]CheckResult
+	started bool
+}
+
+func newHealthRegistry() *healthRegistry {
+	return &healthRegistry{
+		results: map[string]CheckResult{},
+	}
+}
+
+// AddHealthCheck registers a named health check, see AddProbeEndpoints
+func (b *Base) AddHealthCheck(check HealthCheck) {
+	if check.Probes == 0 {
+		check.Probes = ReadinessProbe
+	}
+
+	if check.Timeout <= 0 {
+		check.Timeout = DefaultCheckTimeout
+	}
+
+	b.health.Lock()
+	defer b.health.Unlock()
+
+	b.health.checks = append(b.health.checks, check)
+}
+
+// RunHealthChecks runs all the checks for the given probe concurrently and returns the results
+func (b *Base) RunHealthChecks(ctx context.Context, probe Probe) ProbeResult {
+	b.health.Lock()
+
+	checks := []HealthCheck{}
+
+	for _, check := range b.health.checks {
+		if check.Probes&probe != 0 {
+			checks = append(checks, check)
+		}
+	}
+
+	b.health.Unlock()
+
+	results := make([]CheckResult, len(checks))
+	wg := sync.WaitGroup{}
+
+	for i, check := range checks {
+		wg.Add(1)
+
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+
+			results[i] = b.health.run(ctx, check)
+		}(i, check)
+	}
+
+	wg.Wait()
+
+	healthy := true
+
+	for _, result := range results {
+		if !result.Healthy && result.Critical {
+			healthy = false
+		}
+	}
+
+	return ProbeResult{
+		Probe:   probe.String(),
+		Healthy: healthy,
+		Checks:  results,
+	}
+}
+
+// AddProbeEndpoints adds /livez, /readyz and /startupz endpoints to the router
+// Each returns 200 or 503, with a JSON breakdown of every check when ?verbose is passed
+func (b *Base) AddProbeEndpoints(r chi.Router) {
+	log.Printf("### 💚 API: probe endpoints at: /livez /readyz /startupz")
+
+	for _, probe := range []Probe{LivenessProbe, ReadinessProbe, StartupProbe} {
+		b.Document(http.MethodGet, probe.path()).
+			Describe("Kubernetes "+probe.String()+" probe", "Pass ?verbose for a JSON breakdown of every check").
+			Tag("operations").
+			Returns(http.StatusOK, "Probe passed", ProbeResult{}, "text/plain", "application/json").
+			Returns(http.StatusServiceUnavailable, "Probe failed", ProbeResult{}, "text/plain", "application/json")
+	}
+
+	r.Get(LivenessProbe.path(), b.probeHandler(LivenessProbe))
+	r.Get(ReadinessProbe.path(), b.probeHandler(ReadinessProbe))
+	r.Get(StartupProbe.path(), b.probeHandler(StartupProbe))
+}
+
+func (b *Base) probeHandler(probe Probe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var result ProbeResult
+
+		b.health.Lock()
+		started := b.health.started
+		b.health.Unlock()
+
+		// Once startup has succeeded it stays that way, and the checks are not run again
+		if probe == StartupProbe && started {
+			result = ProbeResult{Probe: probe.String(), Healthy: true, Checks: []CheckResult{}}
+		} else {
+			result = b.RunHealthChecks(r.Context(), probe)
+		}
+
+		if probe == StartupProbe && result.Healthy {
+			b.health.Lock()
+			b.health.started = true
+			b.health.Unlock()
+		}
+
+		// Not ready when shutting down or flagged unhealthy
+		if probe == ReadinessProbe && b.Health().Level == Unhealthy {
+			result.Healthy = false
+		}
+
+		verbose := r.URL.Query().Has("verbose")
+
+		// The content type has to be set before the status is written, or it's sniffed as text
+		if verbose {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "text/plain")
+		}
+
+		if !result.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		if verbose {
+			b.ReturnJSON(w, result)
+			return
+		}
+
+		if result.Healthy {
+			b.ReturnText(w, "OK")
+		} else {
+			b.ReturnText(w, "FAIL")
+		}
+	}
+}
+
+// run executes a single check, honouring the timeout and cached results
+func (hr *healthRegistry) run(ctx context.Context, check HealthCheck) CheckResult {
+	if check.CacheTTL > 0 {
+		hr.Lock()
+		cached, ok := hr.results[check.Name]
+		hr.Unlock()
+
+		if ok && time.Since(cached.checkedAt) < check.CacheTTL {
+			cached.Cached = true
+			return cached
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, check.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	errChan := make(chan error, 1)
+
+	// Run in a goroutine so a check that ignores the context can't block the probe
+	go func() {
+		errChan <- check.Check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errChan:
+	case <-ctx.Done():
+		err = ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = errors.New("check timed out after " + check.Timeout.String())
+		}
+	}
+
+	result := CheckResult{
+		Name:      check.Name,
+		Healthy:   err == nil,
+		Critical:  check.Critical,
+		Duration:  time.Since(start).String(),
+		checkedAt: time.Now(),
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	if check.CacheTTL > 0 {
+		hr.Lock()
+		hr.results[check.Name] = result
+		hr.Unlock()
+	}
+
+	return result
+}
+
+func (p Probe) path() string {
+	switch p {
+	case LivenessProbe:
+		return "/livez"
+	case ReadinessProbe:
+		return "/readyz"
+	default:
+		return "/startupz"
+	}
+}
+
+func (p Probe) String() string {
+	switch p {
+	case LivenessProbe:
+		return "liveness"
+	case ReadinessProbe:
+		return "readiness"
+	case StartupProbe:
+		return "startup"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,380 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Idempotency-Key support, so clients can safely retry POST requests
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/benc-uk/go-rest-api/pkg/auth"
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+)
+
+// IdempotencyHeader is the request header holding the client's key
+const IdempotencyHeader = "Idempotency-Key"
+
+// Longest key accepted, keys are normally UUIDs
+const maxIdempotencyKeyLength = 255
+
+// IdempotentResponse is a stored response, replayed when a request is retried
+type IdempotentResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// IdempotencyRecord is what a store holds for a key
+type IdempotencyRecord struct {
+	// Hash of the method, path & body of the first request with the key
+	Fingerprint string
+
+	// Nil while the first request is still in flight
+	Response *IdempotentResponse
+}
+
+// IdempotencyStore holds idempotency records, implement it to share them between replicas, e.g. with Redis
+type IdempotencyStore interface {
+	// Begin claims a key for a new request, when the key is already held its existing record is returned instead
+	Begin(ctx context.Context, key string, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error)
+
+	// Complete saves the response for a key claimed with Begin
+	Complete(ctx context.Context, key string, resp *IdempotentResponse, ttl time.Duration) error
+
+	// Release removes a claimed key without saving a response, so the request can be retried
+	Release(ctx context.Context, key string) error
+}
+
+// Idempotency replays the first response to requests retried with the same Idempotency-Key, see NewIdempotency
+type Idempotency struct {
+	Store IdempotencyStore
+
+	// How long responses are kept for retries
+	TTL time.Duration
+
+	// Keys are scoped to the principal, so clients can't see each other's responses
+	// Defaults to the tenant & subject of the verified principal, see auth.PrincipalFrom, otherwise
+	// a hash of the Authorization header
+	Principal KeyFunc
+
+	// Send a 400 problem when the header is missing, rather than handling the request normally
+	Required bool
+
+	// Maximum size of the request body in bytes, it's read into memory to fingerprint the request
+	// Larger bodies get a 413 problem, zero or less means no limit
+	MaxBodyBytes int64
+}
+
+// NewIdempotency creates idempotency middleware with an in memory store, keeping responses for the TTL
+// The body limit is the same as Bind, 1MB
+func NewIdempotency(ttl time.Duration) *Idempotency {
+	return &Idempotency{
+		Store:        NewMemoryIdempotencyStore(),
+		TTL:          ttl,
+		MaxBodyBytes: DefaultBindOptions.MaxBodyBytes,
+	}
+}
+
+// Middleware handles the Idempotency-Key header on POST & PATCH requests, other methods are already idempotent
+// The first response is stored and replayed to retries with an Idempotent-Replayed header, while the first is
+// in flight retries get a 409 problem, and reusing a key with a different request body gets a 422 problem
+// Server errors & streamed responses aren't stored, so those requests can be retried
+func (id *Idempotency) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPatch {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		idemKey := r.Header.Get(IdempotencyHeader)
+		if idemKey == "" || len(idemKey) > maxIdempotencyKeyLength {
+			if idemKey == "" && !id.Required {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			problem.New(problemType(http.StatusBadRequest), http.StatusText(http.StatusBadRequest), http.StatusBadRequest,
+				fmt.Sprintf("a %s header of 1 to %d characters is required", IdempotencyHeader, maxIdempotencyKeyLength),
+				r.RequestURI).SendWithRequest(w, r)
+
+			return
+		}
+
+		if id.MaxBodyBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, id.MaxBodyBytes)
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				problem.New("request-too-large", "Request body too large", http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("body must be no more than %d bytes", maxBytesErr.Limit), r.RequestURI).SendWithRequest(w, r)
+
+				return
+			}
+
+			problem.Wrap(http.StatusBadRequest, problemType(http.StatusBadRequest), r.RequestURI, err).SendWithRequest(w, r)
+
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		principal := defaultPrincipalKey(r)
+		if id.Principal != nil {
+			principal = id.Principal(r)
+		}
+
+		key := principal + "|" + idemKey
+		fingerprint := requestFingerprint(r, body)
+
+		existing, err := id.Store.Begin(r.Context(), key, fingerprint, id.TTL)
+		if err != nil {
+			// Without the store there's no way to detect retries, but that's no worse than not using a key
+			log.Printf("### ⚠️ API: idempotency store failed, handling request without it: %s", err)
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		if existing != nil {
+			replayIdempotent(w, r, existing, fingerprint)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK, before: w.Header().Clone()}
+		stored := false
+
+		// Release the key if the handler panics or the response can't be stored, so the client can retry
+		defer func() {
+			if !stored {
+				if err := id.Store.Release(context.WithoutCancel(r.Context()), key); err != nil {
+					log.Printf("### ⚠️ API: idempotency store failed to release key: %s", err)
+				}
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if rec.streaming || rec.status >= http.StatusInternalServerError {
+			return
+		}
+
+		resp := &IdempotentResponse{Status: rec.status, Header: rec.handlerHeaders(), Body: rec.buf.Bytes()}
+		if err := id.Store.Complete(context.WithoutCancel(r.Context()), key, resp, id.TTL); err != nil {
+			log.Printf("### ⚠️ API: idempotency store failed to save response: %s", err)
+			return
+		}
+
+		stored = true
+	})
+}
+
+// replayIdempotent responds to a retry, with the stored response or a problem
+func replayIdempotent(w http.ResponseWriter, r *http.Request, existing *IdempotencyRecord, fingerprint string) {
+	if existing.Fingerprint != fingerprint {
+		problem.New(problemType(http.StatusUnprocessableEntity), http.StatusText(http.StatusUnprocessableEntity),
+			http.StatusUnprocessableEntity,
+			fmt.Sprintf("the %s has already been used for a different request", IdempotencyHeader),
+			r.RequestURI).SendWithRequest(w, r)
+
+		return
+	}
+
+	if existing.Response == nil {
+		w.Header().Set("Retry-After", "1")
+		problem.New(problemType(http.StatusConflict), http.StatusText(http.StatusConflict), http.StatusConflict,
+			fmt.Sprintf("a request with this %s is still being processed", IdempotencyHeader),
+			r.RequestURI).SendWithRequest(w, r)
+
+		return
+	}
+
+	for name, values := range existing.Response.Header {
+		w.Header()[name] = values
+	}
+
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(existing.Response.Status)
+	_, _ = w.Write(existing.Response.Body)
+}
+
+// requestFingerprint identifies a request by its method, path & body
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	_, _ = io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	_, _ = h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// defaultPrincipalKey scopes keys to the verified principal, or to the credentials sent when there isn't one
+// Credentials are hashed so they aren't kept in the store
+func defaultPrincipalKey(r *http.Request) string {
+	if p := auth.PrincipalFrom(r.Context()); p != nil && p.Subject != "" {
+		return p.Tenant + "/" + p.Subject
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(authHeader))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyRecorder copies the response as it's written, so it can be stored
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status      int
+	buf         bytes.Buffer
+	before      http.Header
+	header      http.Header
+	wroteHeader bool
+	streaming   bool
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.header = rec.Header().Clone()
+		rec.wroteHeader = true
+	}
+
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+
+	rec.buf.Write(b)
+
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush marks the response as streamed, these aren't stored
+func (rec *idempotencyRecorder) Flush() {
+	rec.streaming = true
+
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// handlerHeaders are the headers set by the handler, ones set earlier such as the request ID are left out
+func (rec *idempotencyRecorder) handlerHeaders() http.Header {
+	headers := http.Header{}
+
+	for name, values := range rec.header {
+		if before, ok := rec.before[name]; ok && slices.Equal(before, values) {
+			continue
+		}
+
+		headers[name] = values
+	}
+
+	return headers
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore for a single replica, expired records are removed as it goes
+type MemoryIdempotencyStore struct {
+	sync.Mutex
+	records   map[string]*memoryIdempotencyRecord
+	lastSweep time.Time
+}
+
+type memoryIdempotencyRecord struct {
+	IdempotencyRecord
+	expires time.Time
+}
+
+// How often expired records are removed from the memory store
+const idempotencySweepInterval = time.Minute
+
+// NewMemoryIdempotencyStore creates an empty in memory store
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		records: map[string]*memoryIdempotencyRecord{},
+	}
+}
+
+// Begin implements IdempotencyStore
+func (s *MemoryIdempotencyStore) Begin(_ context.Context, key string, fingerprint string,
+	ttl time.Duration) (*IdempotencyRecord, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(s.lastSweep) > idempotencySweepInterval {
+		for k, rec := range s.records {
+			if now.After(rec.expires) {
+				delete(s.records, k)
+			}
+		}
+
+		s.lastSweep = now
+	}
+
+	if rec, ok := s.records[key]; ok && now.Before(rec.expires) {
+		existing := rec.IdempotencyRecord
+		return &existing, nil
+	}
+
+	s.records[key] = &memoryIdempotencyRecord{
+		IdempotencyRecord: IdempotencyRecord{Fingerprint: fingerprint},
+		expires:           now.Add(ttl),
+	}
+
+	return nil, nil
+}
+
+// Complete implements IdempotencyStore
+func (s *MemoryIdempotencyStore) Complete(_ context.Context, key string, resp *IdempotentResponse,
+	ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	rec, ok := s.records[key]
+	if !ok {
+		return fmt.Errorf("idempotency key %q has not been claimed", key)
+	}
+
+	rec.Response = resp
+	rec.expires = time.Now().Add(ttl)
+
+	return nil
+}
+
+// Release implements IdempotencyStore
+func (s *MemoryIdempotencyStore) Release(_ context.Context, key string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.records, key)
+
+	return nil
+}
@@ -0,0 +1,141 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Server lifecycle, start/stop hooks and graceful shutdown
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// DefaultShutdownTimeout is the grace period used to drain connections when none is set
+const DefaultShutdownTimeout = 15 * time.Second
+
+// Hook is a function run when the server starts or stops, see OnStart and OnStop
+type Hook func(ctx context.Context) error
+
+// OnStart registers a hook to be run before the server starts listening
+// Hooks are run in the order they were registered, if any fail the server will not start
+func (b *Base) OnStart(hook Hook) {
+	b.startHooks = append(b.startHooks, hook)
+}
+
+// OnStop registers a hook to be run after the server has stopped accepting requests
+// Hooks are run in the order they were registered, e.g. closing DB pools, flushing brokers
+func (b *Base) OnStop(hook Hook) {
+	b.stopHooks = append(b.stopHooks, hook)
+}
+
+// StartServer starts the HTTP server and blocks until it exits
+// The server will shutdown gracefully on SIGINT or SIGTERM, returning nil
+func (b *Base) StartServer(port int, router chi.Router, timeout time.Duration) error {
+	return b.StartServerContext(context.Background(), port, router, timeout)
+}
+
+// StartServerContext is the same as StartServer but will also shutdown when the context is cancelled
+func (b *Base) StartServerContext(ctx context.Context, port int, router chi.Router, timeout time.Duration) error {
+	srv := &http.Server{
+		Handler:      router,
+		Addr:         fmt.Sprintf(":%d", port),
+		WriteTimeout: timeout,
+		ReadTimeout:  timeout,
+		IdleTimeout:  timeout,
+	}
+
+	log.Printf("### 🌐 %s API, listening on port: %d", b.ServiceName, port)
+	log.Printf("### 🚀 Build details: %s (%s)", b.Version, b.BuildInfo)
+
+	return b.run(ctx, srv, srv.ListenAndServe)
+}
+
+// run handles the lifecycle of the server, start hooks, serving, signals, draining and stop hooks
+// If an admin server has been enabled it is run alongside, and shut down after the main server
+func (b *Base) run(ctx context.Context, srv *http.Server, serve func() error) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for i, hook := range b.startHooks {
+		if err := hook(ctx); err != nil {
+			return fmt.Errorf("start hook %d failed: %w", i, err)
+		}
+	}
+
+	servers := []*http.Server{srv}
+	serveFuncs := []func() error{serve}
+
+	if b.admin != nil {
+		b.admin.ReadTimeout = srv.ReadTimeout
+		b.admin.WriteTimeout = srv.WriteTimeout
+		b.admin.IdleTimeout = srv.IdleTimeout
+
+		servers = append(servers, b.admin)
+		serveFuncs = append(serveFuncs, b.admin.ListenAndServe)
+
+		log.Printf("### 🛠️ %s API, admin listener on port: %s", b.ServiceName, strings.TrimPrefix(b.admin.Addr, ":"))
+	}
+
+	serveErr := make(chan error, len(serveFuncs))
+
+	for _, serveFunc := range serveFuncs {
+		go func(serveFunc func() error) {
+			serveErr <- serveFunc()
+		}(serveFunc)
+	}
+
+	var err error
+
+	select {
+	case err = <-serveErr:
+		// A server failed to start or died, still shutdown & run the stop hooks so things get cleaned up
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+	case <-ctx.Done():
+		log.Printf("### 🛑 %s API, shutting down, draining connections", b.ServiceName)
+	}
+
+	// Mark the service as not ready so probes stop sending traffic our way
+	b.markStopping()
+
+	grace := b.ShutdownTimeout
+	if grace <= 0 {
+		grace = DefaultShutdownTimeout
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	for _, s := range servers {
+		if shutdownErr := s.Shutdown(shutdownCtx); shutdownErr != nil {
+			err = errors.Join(err, fmt.Errorf("shutdown of %s failed: %w", s.Addr, shutdownErr))
+		}
+	}
+
+	// Hooks get their own grace period, draining may have used up all of the shutdown one
+	hookCtx, cancelHooks := context.WithTimeout(context.Background(), grace)
+	defer cancelHooks()
+
+	for i, hook := range b.stopHooks {
+		if hookErr := hook(hookCtx); hookErr != nil {
+			err = errors.Join(err, fmt.Errorf("stop hook %d failed: %w", i, hookErr))
+		}
+	}
+
+	log.Printf("### 👋 %s API, stopped", b.ServiceName)
+
+	return err
+}
@@ -0,0 +1,263 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Load shedding, limiting in-flight requests with a fixed or adaptive limit
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConcurrencyAlgorithm decides how the in-flight limit changes
+type ConcurrencyAlgorithm int
+
+const (
+	// FixedLimit never changes the limit
+	FixedLimit ConcurrencyAlgorithm = iota
+
+	// AIMD adds one to the limit while requests are fast, and cuts it by BackoffRatio when one is slower
+	// than LatencyThreshold
+	AIMD
+
+	// Gradient compares recent latency to the long term average, shrinking the limit as latency rises
+	// and growing it while latency stays steady, no threshold needs to be picked
+	Gradient
+)
+
+// Paths that are prioritised by default, probes & metrics need to get through when overloaded
+var priorityPaths = regexp.MustCompile(`(^/metrics)|(^/health)|(^/(live|ready|startup)z)`)
+
+// ConcurrencyOptions configures a ConcurrencyLimiter, zero values are replaced with defaults
+type ConcurrencyOptions struct {
+	Algorithm ConcurrencyAlgorithm
+
+	// Starting limit, or the limit for FixedLimit, defaults to 100
+	Limit int
+
+	// Bounds for the adaptive algorithms, default to 1 & ten times Limit
+	MinLimit int
+	MaxLimit int
+
+	// AIMD only, requests slower than this are a sign of overload, defaults to 1s
+	LatencyThreshold time.Duration
+
+	// AIMD only, the limit is multiplied by this on overload, defaults to 0.9
+	BackoffRatio float64
+
+	// Sent to shed requests in the Retry-After header, defaults to 1s
+	RetryAfter time.Duration
+
+	// Priority requests are never shed and don't count towards the limit, defaults to the probe & metrics paths
+	Priority func(r *http.Request) bool
+}
+
+// ConcurrencyLimiter sheds requests when too many are in flight, see NewConcurrencyLimiter
+type ConcurrencyLimiter struct {
+	name string
+	opts ConcurrencyOptions
+
+	sync.Mutex
+	limit    float64
+	inFlight int
+
+	// Gradient, average latency over a long window
+	longRTT float64
+}
+
+var (
+	concurrencyLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "http_concurrency_limit",
+			Help: "Current limit of in-flight requests",
+		},
+		[]string{"limiter"},
+	)
+
+	concurrencyInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "http_concurrency_in_flight",
+			Help: "Requests in flight, not including priority requests",
+		},
+		[]string{"limiter"},
+	)
+
+	concurrencyShed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_concurrency_shed_total",
+			Help: "Count of requests shed as the limit was reached",
+		},
+		[]string{"limiter"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(concurrencyLimit)
+	prometheus.MustRegister(concurrencyInFlight)
+	prometheus.MustRegister(concurrencyShed)
+}
+
+// NewConcurrencyLimiter creates a limiter, the name is used to label its metrics
+func NewConcurrencyLimiter(name string, opts ConcurrencyOptions) *ConcurrencyLimiter {
+	if opts.Limit <= 0 {
+		opts.Limit = 100
+	}
+
+	if opts.MinLimit <= 0 {
+		opts.MinLimit = 1
+	}
+
+	if opts.MaxLimit <= 0 {
+		opts.MaxLimit = opts.Limit * 10
+	}
+
+	if opts.LatencyThreshold <= 0 {
+		opts.LatencyThreshold = time.Second
+	}
+
+	if opts.BackoffRatio <= 0 || opts.BackoffRatio >= 1 {
+		opts.BackoffRatio = 0.9
+	}
+
+	if opts.RetryAfter <= 0 {
+		opts.RetryAfter = time.Second
+	}
+
+	if opts.Priority == nil {
+		opts.Priority = func(r *http.Request) bool {
+			return priorityPaths.MatchString(r.URL.Path)
+		}
+	}
+
+	cl := &ConcurrencyLimiter{
+		name:  name,
+		opts:  opts,
+		limit: float64(opts.Limit),
+	}
+
+	concurrencyLimit.WithLabelValues(name).Set(cl.limit)
+	concurrencyInFlight.WithLabelValues(name).Set(0)
+
+	return cl
+}
+
+// Limit returns the current in-flight limit
+func (cl *ConcurrencyLimiter) Limit() int {
+	cl.Lock()
+	defer cl.Unlock()
+
+	return int(cl.limit)
+}
+
+// InFlight returns the number of requests in flight, not including priority requests
+func (cl *ConcurrencyLimiter) InFlight() int {
+	cl.Lock()
+	defer cl.Unlock()
+
+	return cl.inFlight
+}
+
+// Middleware sheds requests over the limit with a 503 problem and Retry-After header
+// Put it before other middleware so shed requests cost as little as possible, long lived streams
+// should be made priority requests, or kept off the limited routes, as they would hold on to a slot
+func (cl *ConcurrencyLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cl.opts.Priority(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !cl.acquire() {
+			concurrencyShed.WithLabelValues(cl.name).Inc()
+
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(cl.opts.RetryAfter)))
+			problem.New(problemType(http.StatusServiceUnavailable), http.StatusText(http.StatusServiceUnavailable),
+				http.StatusServiceUnavailable, fmt.Sprintf("server is overloaded, retry in %ds", ceilSeconds(cl.opts.RetryAfter)),
+				r.RequestURI).SendWithRequest(w, r)
+
+			return
+		}
+
+		start := time.Now()
+
+		defer func() {
+			cl.release(time.Since(start))
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (cl *ConcurrencyLimiter) acquire() bool {
+	cl.Lock()
+	defer cl.Unlock()
+
+	if cl.inFlight >= int(cl.limit) {
+		return false
+	}
+
+	cl.inFlight++
+	concurrencyInFlight.WithLabelValues(cl.name).Set(float64(cl.inFlight))
+
+	return true
+}
+
+// release ends a request, updating the limit from its latency
+func (cl *ConcurrencyLimiter) release(rtt time.Duration) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	// Only grow the limit when it's being used, otherwise it climbs forever while the service is quiet
+	busy := float64(cl.inFlight)*2 >= cl.limit
+
+	cl.inFlight--
+	concurrencyInFlight.WithLabelValues(cl.name).Set(float64(cl.inFlight))
+
+	limit := cl.limit
+
+	switch cl.opts.Algorithm {
+	case AIMD:
+		if rtt > cl.opts.LatencyThreshold {
+			limit *= cl.opts.BackoffRatio
+		} else if busy {
+			limit++
+		}
+
+	case Gradient:
+		sample := rtt.Seconds()
+		if cl.longRTT == 0 {
+			cl.longRTT = sample
+		}
+
+		// Exponential average over roughly the last 100 requests
+		cl.longRTT += (sample - cl.longRTT) / 100
+
+		// Below one requests are queueing and the limit shrinks, at one latency is steady or falling
+		// It's capped at one, so a fast request can't grow the limit by more than the headroom below
+		gradient := math.Max(0.5, math.Min(1, cl.longRTT/math.Max(sample, 1e-9)))
+		if gradient == 1 && !busy {
+			return
+		}
+
+		// Headroom so the limit can grow while latency is steady
+		queue := math.Sqrt(limit)
+		limit = 0.8*limit + 0.2*(limit*gradient+queue)
+
+	default:
+		return
+	}
+
+	cl.limit = math.Max(float64(cl.opts.MinLimit), math.Min(float64(cl.opts.MaxLimit), limit))
+	concurrencyLimit.WithLabelValues(cl.name).Set(cl.limit)
+}
@@ -9,49 +9,43 @@ package api
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"log"
 	"net/http"
-	"strings"
-
-	"github.com/go-chi/cors"
+	"strconv"
+	"time"
+
+	"github.com/benc-uk/go-rest-api/pkg/auth"
+	"github.com/benc-uk/go-rest-api/pkg/trace"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	metrics "github.com/m8as/go-chi-metrics"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// Get a value from JWT claim and add it to the request context
-// Note: Ignores any errors, such as missing token or claim
+// enrichedKey is the context key of values added by JWTRequestEnricher
+type enrichedKey string
+
+// Get a value from JWT claim and add it to the request context, read it with EnrichedValue
+// For existing callers it's also still stored under the plain fieldName string key, as it always was
+// The claim is read from the verified principal, so this must come after an auth validator such as
+// auth.JWTValidator. Requests without a principal, e.g. after auth.PassthroughValidator, or where the claim
+// is missing or not a string, are left as is
+//
+// Deprecated: use auth.PrincipalFrom and auth.Claim, which give typed access to all the claims
 func (b *Base) JWTRequestEnricher(fieldName string, claim string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			authHeader := r.Header.Get("Authorization")
-			if len(authHeader) == 0 {
+			value, ok := auth.Claim[string](auth.PrincipalFrom(r.Context()), claim)
+			if !ok {
 				next.ServeHTTP(w, r)
 
 				return
 			}
 
-			authParts := strings.Split(authHeader, " ")
-			if len(authParts) != 2 {
-				next.ServeHTTP(w, r)
+			ctx := context.WithValue(r.Context(), enrichedKey(fieldName), value)
 
-				return
-			}
-
-			if strings.ToLower(authParts[0]) != "bearer" {
-				next.ServeHTTP(w, r)
-
-				return
-			}
-
-			value, err := getClaimFromJWT(authParts[1], claim)
-			if err != nil {
-				next.ServeHTTP(w, r)
-
-				return
-			}
-
-			// nolint:staticcheck
-			ctx := context.WithValue(r.Context(), fieldName, value)
+			//nolint:staticcheck // The string key is kept until this is removed, callers read it directly
+			ctx = context.WithValue(ctx, fieldName, value)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		}
 
@@ -59,50 +53,71 @@ func (b *Base) JWTRequestEnricher(fieldName string, claim string) func(next http
 	}
 }
 
-// SimpleCORSMiddleware adds permissive and open CORS policy
-func (b *Base) SimpleCORSMiddleware(next http.Handler) http.Handler {
-	log.Printf("### 🎭 API: configured simple CORS")
+// EnrichedValue returns a value added to the context by JWTRequestEnricher, or "" if there isn't one
+func EnrichedValue(ctx context.Context, fieldName string) string {
+	value, _ := ctx.Value(enrichedKey(fieldName)).(string)
+	return value
+}
 
-	cors := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	})
+// Request duration histogram, the go-chi-metrics library only has a counter & gauge
+// Observations carry the trace ID as an exemplar, so slow requests can be looked up in the tracing backend
+var requestDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Duration of HTTP requests by route",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"method", "route", "status"},
+)
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cors.Handler(next).ServeHTTP(w, r)
-	})
+func init() {
+	prometheus.MustRegister(requestDuration)
 }
 
-// getClaimFromJWT is a helper to return a claim from a JWT
-// It decodes the raw JWT, parses the JSON and returns the claim
-func getClaimFromJWT(jwtRaw string, claimName string) (string, error) {
-	jwtParts := strings.Split(jwtRaw, ".")
+// MetricsMiddleware records Prometheus request count & duration metrics
+func (b *Base) MetricsMiddleware(next http.Handler) http.Handler {
+	return metrics.SetRequestDuration(metrics.IncRequestCount(observeDuration(next)))
+}
 
-	// Decode base64 main part of the token
-	tokenBytes, err := base64.RawURLEncoding.DecodeString(jwtParts[1])
-	if err != nil {
-		log.Println("### Auth: Error in base64 decoding token", err)
-		return "", err
-	}
+// observeDuration adds requests to the duration histogram, labelled with the route pattern rather than the URL
+func observeDuration(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
 
-	// Parse token JSON
-	var tokenJSON map[string]interface{}
+		next.ServeHTTP(ww, r)
 
-	err = json.Unmarshal(tokenBytes, &tokenJSON)
-	if err != nil {
-		log.Println("### Auth: Error in JSON parsing token", err)
-		return "", err
-	}
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
 
-	// Get the claim
-	claim, ok := tokenJSON[claimName]
-	if !ok {
-		log.Println("### Auth: Claim not found in token", err)
-		return "", err
-	}
+		observer := requestDuration.WithLabelValues(r.Method, route, strconv.Itoa(ww.Status()))
+		elapsed := time.Since(start).Seconds()
+
+		sc := trace.SpanContextFromContext(r.Context())
+		if eo, ok := observer.(prometheus.ExemplarObserver); ok && sc.IsValid() && sc.Sampled {
+			eo.ObserveWithExemplar(elapsed, prometheus.Labels{"trace_id": sc.TraceID.String()})
+			return
+		}
+
+		observer.Observe(elapsed)
+	})
+}
+
+// SimpleCORSMiddleware adds permissive and open CORS policy, allowing any origin but without credentials
+//
+// Deprecated: use NewCORS, which takes a policy that can be loaded with CORSPolicyFromEnv
+func (b *Base) SimpleCORSMiddleware(next http.Handler) http.Handler {
+	log.Printf("### 🎭 API: configured simple CORS")
+
+	// A wildcard origin is always valid without credentials, so there's no error to handle
+	cors, _ := NewCORS(CORSPolicy{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		MaxAge:         300 * time.Second,
+	})
 
-	return claim.(string), nil
+	return cors.Middleware(next)
 }
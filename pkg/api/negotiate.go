@@ -0,0 +1,200 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Content negotiation, picks a response encoder based on the Accept header
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+)
+
+// ErrNotEncodable should be returned by an encoder when it can't represent the data it is given
+// For example CSV can only encode structs & slices of structs. The next acceptable encoder will be tried
+var ErrNotEncodable = errors.New("data can not be represented in this format")
+
+// EncoderFunc writes data to w in a particular format
+type EncoderFunc func(w io.Writer, data any) error
+
+type registeredEncoder struct {
+	mediaType string
+	encode    EncoderFunc
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// RegisterEncoder adds an encoder for a media type, replacing any existing one for that type
+// Encoders are preferred in the order registered when the client accepts several equally
+func (b *Base) RegisterEncoder(mediaType string, enc EncoderFunc) {
+	mediaType = strings.ToLower(mediaType)
+
+	for i, e := range b.encoders {
+		if e.mediaType == mediaType {
+			b.encoders[i].encode = enc
+			return
+		}
+	}
+
+	b.encoders = append(b.encoders, registeredEncoder{mediaType, enc})
+}
+
+// Respond sends data to the client, encoded in the best format for the request Accept header
+// When no format is acceptable a RFC 7807 problem is sent with a 406 status
+func (b *Base) Respond(w http.ResponseWriter, r *http.Request, data any) {
+	b.RespondStatus(w, r, http.StatusOK, data)
+}
+
+// RespondStatus is the same as Respond but with a status code
+func (b *Base) RespondStatus(w http.ResponseWriter, r *http.Request, status int, data any) {
+	w.Header().Add("Vary", "Accept")
+	accept := r.Header.Get("Accept")
+
+	for _, enc := range b.negotiate(accept) {
+		buf := &bytes.Buffer{}
+
+		err := enc.encode(buf, data)
+		if errors.Is(err, ErrNotEncodable) {
+			continue
+		}
+
+		body := buf.Bytes()
+
+		// Sparse fieldsets only apply to JSON, other formats always get the full representation
+		if err == nil && enc.mediaType == "application/json" {
+			body, err = pruneFields(data, body, selectedFields(w))
+		}
+
+		if err != nil {
+			problem.Wrap(500, "response-encoding", "api-internals", err).SendWithRequest(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", enc.mediaType)
+
+		// Successful reads are tagged so clients can revalidate with If-None-Match
+		if status == http.StatusOK && w.Header().Get("ETag") == "" {
+			w.Header().Set("ETag", ETag(body))
+		}
+
+		if status == http.StatusOK && notModified(w, r) {
+			return
+		}
+
+		w.WriteHeader(status)
+		_, _ = w.Write(body)
+
+		return
+	}
+
+	supported := []string{}
+	for _, enc := range b.encoders {
+		supported = append(supported, enc.mediaType)
+	}
+
+	problem.Wrap(http.StatusNotAcceptable, "not-acceptable", r.RequestURI,
+		fmt.Errorf("no acceptable representation for '%s', supported types are: %s",
+			accept, strings.Join(supported, ", "))).SendWithRequest(w, r)
+}
+
+// negotiate returns the encoders matching the Accept header, best first
+func (b *Base) negotiate(accept string) []registeredEncoder {
+	if strings.TrimSpace(accept) == "" {
+		return b.encoders
+	}
+
+	matched := []registeredEncoder{}
+	seen := map[string]bool{}
+
+	for _, ar := range parseAccept(accept) {
+		for _, enc := range b.encoders {
+			if seen[enc.mediaType] || !mediaTypeMatches(ar.mediaType, enc.mediaType) {
+				continue
+			}
+
+			seen[enc.mediaType] = true
+			matched = append(matched, enc)
+		}
+	}
+
+	return matched
+}
+
+// parseAccept parses an Accept header into media ranges, sorted by quality then specificity
+// Ranges with a quality of zero are dropped
+func parseAccept(accept string) []acceptRange {
+	ranges := []acceptRange{}
+
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		if mediaType == "" {
+			continue
+		}
+
+		q := 1.0
+
+		for _, param := range params[1:] {
+			key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(key) == "q" {
+				if parsed, err := strconv.ParseFloat(val, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		if q <= 0 {
+			continue
+		}
+
+		ranges = append(ranges, acceptRange{mediaType, q})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].q != ranges[j].q {
+			return ranges[i].q > ranges[j].q
+		}
+
+		return specificity(ranges[i].mediaType) > specificity(ranges[j].mediaType)
+	})
+
+	return ranges
+}
+
+// specificity ranks type/subtype above type/* above */*
+func specificity(mediaType string) int {
+	switch {
+	case mediaType == "*/*":
+		return 0
+	case strings.HasSuffix(mediaType, "/*"):
+		return 1
+	default:
+		return 2
+	}
+}
+
+func mediaTypeMatches(mediaRange string, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+
+	if prefix, ok := strings.CutSuffix(mediaRange, "/*"); ok {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+
+	return false
+}
@@ -0,0 +1,606 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// OpenAPI 3.1 document generation from routes registered with the library
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	_ "embed"
+	"encoding"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+	"github.com/go-chi/chi/v5"
+)
+
+//go:embed openapi-docs.html
+var docsPage string
+
+// Content security policy of the docs page, it only needs its own inline script & styles, and to fetch the spec
+const docsPagePolicy = "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; " +
+	"connect-src 'self'; frame-ancestors 'none'"
+
+// SecuritySchemeName is the name of the JWT bearer scheme in generated documents
+const SecuritySchemeName = "jwt"
+
+// Operation describes a single route in the OpenAPI document, the methods can be chained
+type Operation struct {
+	method      string
+	path        string
+	summary     string
+	description string
+	tags        []string
+	secured     bool
+	scopes      []string
+	request     reflect.Type
+	responses   []opResponse
+}
+
+type opResponse struct {
+	status       int
+	description  string
+	body         reflect.Type
+	contentTypes []string
+}
+
+// apiSpec holds all documented operations, in the order they were registered
+type apiSpec struct {
+	sync.Mutex
+	operations []*Operation
+}
+
+var (
+	pathParamRegex    = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+	problemStructType = reflect.TypeOf(problem.Problem{})
+	timeType          = reflect.TypeOf(time.Time{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Document adds an operation to the OpenAPI document, use this to describe routes not added with Handle
+// Routes are documented with the pattern as registered, so should be the full path from the root
+func (b *Base) Document(method string, pattern string) *Operation {
+	op := &Operation{
+		method: strings.ToLower(method),
+		path:   pathParamRegex.ReplaceAllString(pattern, "{$1}"),
+	}
+
+	b.spec.Lock()
+	defer b.spec.Unlock()
+
+	b.spec.operations = append(b.spec.operations, op)
+
+	return op
+}
+
+// Describe sets the summary and optional longer description of the operation
+func (op *Operation) Describe(summary string, description string) *Operation {
+	op.summary = summary
+	op.description = description
+
+	return op
+}
+
+// Tag groups the operation under the given tags
+func (op *Operation) Tag(tags ...string) *Operation {
+	op.tags = append(op.tags, tags...)
+	return op
+}
+
+// Secure marks the operation as requiring a JWT bearer token, e.g. protected with auth.JWTValidator
+func (op *Operation) Secure(scopes ...string) *Operation {
+	op.secured = true
+	op.scopes = append(op.scopes, scopes...)
+
+	return op
+}
+
+// Accepts sets the type of the request, its body, path & query params are documented
+func (op *Operation) Accepts(body any) *Operation {
+	op.request = reflect.TypeOf(body)
+	return op
+}
+
+// Returns documents a response, body can be nil, content types default to those registered for Respond
+func (op *Operation) Returns(status int, description string, body any, contentTypes ...string) *Operation {
+	op.responses = append(op.responses, opResponse{
+		status:       status,
+		description:  description,
+		body:         reflect.TypeOf(body),
+		contentTypes: contentTypes,
+	})
+
+	return op
+}
+
+// AddOpenAPIEndpoint serves the OpenAPI document as JSON at /path and a docs UI page at /path/docs
+// The docs page is self contained and works offline
+func (b *Base) AddOpenAPIEndpoint(r chi.Router, path string) {
+	log.Printf("### 📜 API: OpenAPI document at: %s, docs at: %s", "/"+path, "/"+path+"/docs")
+
+	r.Get("/"+path, func(w http.ResponseWriter, r *http.Request) {
+		b.ReturnJSON(w, b.OpenAPISpec())
+	})
+
+	page := strings.ReplaceAll(docsPage, "{{SPEC_URL}}", "/"+path)
+
+	r.Get("/"+path+"/docs", func(w http.ResponseWriter, r *http.Request) {
+		// The page has inline script & styles, which a strict policy from SecurityHeadersMiddleware would block
+		w.Header().Set("Content-Security-Policy", docsPagePolicy)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(page))
+	})
+}
+
+// OpenAPISpec builds the OpenAPI 3.1 document for all the documented operations
+func (b *Base) OpenAPISpec() map[string]any {
+	gen := &schemaGen{components: map[string]any{}, names: map[reflect.Type]string{}}
+	paths := map[string]map[string]any{}
+
+	mediaTypes := []string{}
+	for _, enc := range b.encoders {
+		mediaTypes = append(mediaTypes, enc.mediaType)
+	}
+
+	b.spec.Lock()
+	operations := append([]*Operation{}, b.spec.operations...)
+	b.spec.Unlock()
+
+	// Problem schema is always included, as it's the default error response, added first so it keeps its name
+	gen.schema(problemStructType)
+
+	for _, op := range operations {
+		if paths[op.path] == nil {
+			paths[op.path] = map[string]any{}
+		}
+
+		paths[op.path][op.method] = gen.operation(op, mediaTypes)
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":       b.ServiceName,
+			"version":     b.Version,
+			"description": b.BuildInfo,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": gen.components,
+			"securitySchemes": map[string]any{
+				SecuritySchemeName: map[string]any{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+					"description": "OAuth2 JWT access token, signature checked against the JWKS " +
+						"with audience & scope claims validated",
+				},
+			},
+		},
+	}
+}
+
+// schemaGen reflects Go types into JSON schemas, named structs are added to the components
+type schemaGen struct {
+	components map[string]any
+
+	// Component name of each struct type, names are unique even when types from different packages share one
+	names map[reflect.Type]string
+}
+
+func (g *schemaGen) operation(op *Operation, mediaTypes []string) map[string]any {
+	doc := map[string]any{
+		"operationId": operationID(op.method, op.path),
+	}
+
+	if op.summary != "" {
+		doc["summary"] = op.summary
+	}
+
+	if op.description != "" {
+		doc["description"] = op.description
+	}
+
+	if len(op.tags) > 0 {
+		doc["tags"] = op.tags
+	}
+
+	if op.secured {
+		scopes := op.scopes
+		if scopes == nil {
+			scopes = []string{}
+		}
+
+		doc["security"] = []map[string][]string{{SecuritySchemeName: scopes}}
+	}
+
+	responses := map[string]any{
+		"default": g.problemResponse("Error"),
+	}
+
+	if op.request != nil {
+		params, body := g.requestParts(op.request)
+
+		if len(params) > 0 {
+			doc["parameters"] = params
+		}
+
+		if body != nil {
+			doc["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json":                  map[string]any{"schema": body},
+					"application/x-www-form-urlencoded": map[string]any{"schema": body},
+				},
+			}
+		}
+
+		responses["400"] = g.problemResponse("Invalid request")
+	}
+
+	if op.secured {
+		responses["401"] = map[string]any{"description": "Missing or invalid token"}
+	}
+
+	for _, resp := range op.responses {
+		description := resp.description
+		if description == "" {
+			description = http.StatusText(resp.status)
+		}
+
+		respDoc := map[string]any{"description": description}
+
+		if resp.body != nil {
+			types := resp.contentTypes
+			if len(types) == 0 {
+				types = mediaTypes
+			}
+
+			content := map[string]any{}
+			for _, mediaType := range types {
+				content[mediaType] = map[string]any{"schema": g.schema(resp.body)}
+			}
+
+			respDoc["content"] = content
+		}
+
+		responses[strconv.Itoa(resp.status)] = respDoc
+	}
+
+	doc["responses"] = responses
+
+	return doc
+}
+
+func (g *schemaGen) problemResponse(description string) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content": map[string]any{
+			"application/json": map[string]any{"schema": g.schema(problemStructType)},
+		},
+	}
+}
+
+// requestParts splits a request type into path & query parameters and a body schema
+func (g *schemaGen) requestParts(t reflect.Type) ([]map[string]any, map[string]any) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	params := []map[string]any{}
+	if t.Kind() != reflect.Struct {
+		return params, nil
+	}
+
+	hasBody := false
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		location := ""
+		name := ""
+
+		if n, ok := field.Tag.Lookup("path"); ok {
+			location, name = "path", n
+		} else if n, ok := field.Tag.Lookup("query"); ok {
+			location, name = "query", n
+		}
+
+		if location == "" {
+			if fieldName(field) != "" {
+				hasBody = true
+			}
+
+			continue
+		}
+
+		schema, required := g.fieldSchema(field)
+
+		params = append(params, map[string]any{
+			"name":     name,
+			"in":       location,
+			"required": required || location == "path",
+			"schema":   schema,
+		})
+	}
+
+	if !hasBody {
+		return params, nil
+	}
+
+	return params, g.schema(t)
+}
+
+// schema returns the schema for a type, structs are added to the components and referenced
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	// Types such as enums that serialize themselves as text
+	if t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType) {
+		return map[string]any{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.structSchema(t)
+	default:
+		return map[string]any{}
+	}
+}
+
+// structSchema returns a reference to the component for a named struct, anonymous structs are inlined
+func (g *schemaGen) structSchema(t reflect.Type) map[string]any {
+	if t.Name() == "" {
+		return g.objectSchema(t)
+	}
+
+	// Already done or in progress, which handles recursive types
+	if name, ok := g.names[t]; ok {
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+
+	name := g.componentName(t)
+	g.names[t] = name
+	g.components[name] = map[string]any{}
+	g.components[name] = g.objectSchema(t)
+
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+// componentName picks a name not used by another type, e.g. Problem, then problem.Problem, then problem.Problem2
+func (g *schemaGen) componentName(t reflect.Type) string {
+	name := schemaName(t)
+	if _, taken := g.components[name]; !taken {
+		return name
+	}
+
+	pkg := t.PkgPath()
+	if i := strings.LastIndex(pkg, "/"); i >= 0 {
+		pkg = pkg[i+1:]
+	}
+
+	name = schemaName(t, pkg)
+	qualified := name
+
+	for i := 2; ; i++ {
+		if _, taken := g.components[name]; !taken {
+			return name
+		}
+
+		name = qualified + strconv.Itoa(i)
+	}
+}
+
+// objectSchema builds the object schema for the fields of a struct
+func (g *schemaGen) objectSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+
+	g.addProperties(t, properties, &required, map[reflect.Type]bool{})
+
+	schema := map[string]any{
+		"type":       "object",
+		"properties": properties,
+	}
+
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+// addProperties adds the fields of a struct to the properties, flattening embedded structs as encoding/json does
+// Fields of the outer struct win over promoted fields with the same name
+func (g *schemaGen) addProperties(t reflect.Type, properties map[string]any, required *[]string,
+	seen map[reflect.Type]bool) {
+	if seen[t] {
+		return
+	}
+
+	seen[t] = true
+	embedded := []reflect.Type{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		// Embedded structs without a JSON name have their fields promoted
+		if field.Anonymous && !hasJSONName(field) {
+			ft := field.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+
+			if ft.Kind() == reflect.Struct && (field.IsExported() || field.Type.Kind() != reflect.Pointer) {
+				embedded = append(embedded, ft)
+				continue
+			}
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		// Params are documented separately, they are not part of the body
+		_, isPath := field.Tag.Lookup("path")
+		_, isQuery := field.Tag.Lookup("query")
+
+		name := fieldName(field)
+		if name == "" || isPath || isQuery {
+			continue
+		}
+
+		if _, exists := properties[name]; exists {
+			continue
+		}
+
+		schema, isRequired := g.fieldSchema(field)
+		properties[name] = schema
+
+		if isRequired {
+			*required = append(*required, name)
+		}
+	}
+
+	for _, et := range embedded {
+		g.addProperties(et, properties, required, seen)
+	}
+}
+
+// hasJSONName reports if a field's json tag gives it a name
+func hasJSONName(field reflect.StructField) bool {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	return name != ""
+}
+
+// fieldSchema returns the schema for a struct field, with constraints from validate tags
+func (g *schemaGen) fieldSchema(field reflect.StructField) (map[string]any, bool) {
+	base := g.schema(field.Type)
+	required := false
+
+	tag, ok := field.Tag.Lookup("validate")
+	if !ok {
+		return base, false
+	}
+
+	// Copy so constraints don't leak into shared schemas, and avoid siblings alongside $ref
+	schema := map[string]any{}
+	if _, isRef := base["$ref"]; isRef {
+		schema["allOf"] = []any{base}
+	} else {
+		for k, v := range base {
+			schema[k] = v
+		}
+	}
+
+	kind := field.Type.Kind()
+	if kind == reflect.Pointer {
+		kind = field.Type.Elem().Kind()
+	}
+
+	for _, rule := range splitRules(tag) {
+		name, arg, _ := strings.Cut(rule, "=")
+
+		switch name {
+		case "required":
+			required = true
+		case "min", "max":
+			n, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				continue
+			}
+
+			schema[boundKeyword(kind, name)] = n
+		case "enum":
+			schema["enum"] = strings.Split(arg, "|")
+		case "email":
+			schema["format"] = "email"
+		case "uuid":
+			schema["format"] = "uuid"
+		case "regex":
+			schema["pattern"] = arg
+		}
+	}
+
+	return schema, required
+}
+
+// boundKeyword maps min/max to the JSON schema keyword for the kind of value, e.g. minLength
+func boundKeyword(kind reflect.Kind, rule string) string {
+	switch kind {
+	case reflect.String:
+		return rule + "Length"
+	case reflect.Slice, reflect.Array:
+		return rule + "Items"
+	case reflect.Map:
+		return rule + "Properties"
+	default:
+		return rule + "imum"
+	}
+}
+
+// schemaName makes a component name from a type, e.g. problem.Problem -> Problem
+// With a prefix, normally the package name, it is qualified, e.g. problem.Problem
+func schemaName(t reflect.Type, prefix ...string) string {
+	name := strings.Join(append(prefix, t.Name()), ".")
+
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-' {
+			return r
+		}
+
+		return '_'
+	}, name)
+}
+
+// operationID makes an ID from the method & path, e.g. GET /things/{id} -> getThingsId
+func operationID(method string, path string) string {
+	words := strings.FieldsFunc(path, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	id := method
+	for _, word := range words {
+		id += strings.ToUpper(word[:1]) + word[1:]
+	}
+
+	return id
+}
@@ -0,0 +1,313 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Offset & cursor pagination, with signed cursors and RFC 8288 Link headers
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+)
+
+// Paginator parses paging query params and builds links, so every list endpoint pages the same way
+type Paginator struct {
+	// Limit used when none is given
+	DefaultLimit int
+
+	// Limits above this are capped
+	MaxLimit int
+
+	secret []byte
+}
+
+// Page is the requested page of results, parsed from the query string
+type Page struct {
+	Limit  int
+	Offset int
+
+	// Key of the last item on the previous page, for keyset pagination, only set from a cursor
+	After string
+
+	url    *url.URL
+	cursor bool
+}
+
+// PageInfo describes the results of fetching a page
+type PageInfo struct {
+	// Total number of items, nil if not known
+	Total *int
+
+	// Are there more items after this page
+	HasMore bool
+
+	// For keyset pagination, the key of the last item on this page, used in the next cursor
+	NextAfter string
+}
+
+// PageLinks holds the URLs of the first, next & previous pages, empty when there isn't one
+type PageLinks struct {
+	First string `json:"first"`
+	Next  string `json:"next,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+}
+
+// PageEnvelope wraps a page of items with counts & links, it also sets the Link header
+type PageEnvelope[T any] struct {
+	Items  []T       `json:"items"`
+	Total  *int      `json:"total,omitempty"`
+	Limit  int       `json:"limit"`
+	Offset int       `json:"offset"`
+	Links  PageLinks `json:"links"`
+}
+
+// cursorData is what's held in an opaque cursor
+type cursorData struct {
+	Offset int    `json:"o,omitempty"`
+	After  string `json:"a,omitempty"`
+	Limit  int    `json:"l,omitempty"`
+}
+
+// NewPaginator creates a Paginator with a default limit of 20 and max of 100
+// The secret is used to sign cursors, if empty a random one is used and cursors won't survive restarts
+func NewPaginator(secret []byte) *Paginator {
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		_, _ = rand.Read(secret)
+	}
+
+	return &Paginator{
+		DefaultLimit: 20,
+		MaxLimit:     100,
+		secret:       secret,
+	}
+}
+
+// Parse reads the limit & offset, or cursor, query params
+// Limits over the max are capped, anything invalid or a tampered cursor results in a 400 problem
+func (p *Paginator) Parse(r *http.Request) (Page, *problem.Problem) {
+	query := r.URL.Query()
+	page := Page{Limit: p.DefaultLimit, url: r.URL}
+	invalid := []problem.InvalidParam{}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		if query.Has("offset") {
+			invalid = append(invalid, problem.InvalidParam{Name: "offset", Reason: "can not be used with a cursor"})
+		}
+
+		data, err := p.decodeCursor(cursor)
+		if err != nil {
+			invalid = append(invalid, problem.InvalidParam{Name: "cursor", Reason: err.Error()})
+		}
+
+		page.cursor = true
+		page.Offset = data.Offset
+		page.After = data.After
+
+		if data.Limit > 0 {
+			page.Limit = data.Limit
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			invalid = append(invalid, problem.InvalidParam{Name: "limit", Reason: "must be a positive integer"})
+		}
+
+		page.Limit = limit
+	}
+
+	if value := query.Get("offset"); value != "" && !page.cursor {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			invalid = append(invalid, problem.InvalidParam{Name: "offset", Reason: "must be zero or a positive integer"})
+		}
+
+		page.Offset = offset
+	}
+
+	page.Limit = min(page.Limit, p.MaxLimit)
+
+	// Offsets this large would overflow when working out the next page
+	if len(invalid) == 0 && page.Offset > math.MaxInt-page.Limit {
+		invalid = append(invalid, problem.InvalidParam{
+			Name:   "offset",
+			Reason: fmt.Sprintf("must be no more than %d", math.MaxInt-page.Limit),
+		})
+	}
+
+	if len(invalid) > 0 {
+		return page, invalidProblem(r, invalid)
+	}
+
+	return page, nil
+}
+
+// Links builds the links to the first, next & previous pages
+// Pages requested with a cursor get cursor links, otherwise limit & offset are used
+func (p *Paginator) Links(page Page, info PageInfo) PageLinks {
+	links := PageLinks{
+		First: p.pageURL(page, cursorData{Limit: page.Limit}),
+	}
+
+	hasNext := info.HasMore || (info.Total != nil && page.Offset+page.Limit < *info.Total)
+	if hasNext {
+		links.Next = p.pageURL(page, cursorData{
+			Offset: page.Offset + page.Limit,
+			After:  info.NextAfter,
+			Limit:  page.Limit,
+		})
+	}
+
+	// Keyset pages can only go forwards, there's no key to go back from
+	if page.Offset > 0 && page.After == "" && info.NextAfter == "" {
+		links.Prev = p.pageURL(page, cursorData{
+			Offset: max(0, page.Offset-page.Limit),
+			Limit:  page.Limit,
+		})
+	}
+
+	return links
+}
+
+// SetLinkHeader adds a RFC 8288 Link header with the page links to the response, and returns them
+func (p *Paginator) SetLinkHeader(w http.ResponseWriter, page Page, info PageInfo) PageLinks {
+	links := p.Links(page, info)
+	w.Header().Set("Link", links.header())
+
+	return links
+}
+
+// NewPageEnvelope wraps a page of items, with the total if known and the page links
+func NewPageEnvelope[T any](p *Paginator, items []T, page Page, info PageInfo) PageEnvelope[T] {
+	env := PageEnvelope[T]{
+		Items:  items,
+		Limit:  page.Limit,
+		Offset: page.Offset,
+		Links:  p.Links(page, info),
+	}
+
+	if env.Items == nil {
+		env.Items = []T{}
+	}
+
+	if info.Total != nil {
+		total := *info.Total
+		env.Total = &total
+	}
+
+	return env
+}
+
+// SetHeaders adds the Link header when the envelope is returned from a typed handler
+func (env PageEnvelope[T]) SetHeaders(h http.Header) {
+	h.Set("Link", env.Links.header())
+}
+
+func (links PageLinks) header() string {
+	parts := []string{fmt.Sprintf(`<%s>; rel="first"`, links.First)}
+
+	if links.Prev != "" {
+		parts = append(parts, fmt.Sprintf(`<%s>; rel="prev"`, links.Prev))
+	}
+
+	if links.Next != "" {
+		parts = append(parts, fmt.Sprintf(`<%s>; rel="next"`, links.Next))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// pageURL builds a URL relative to the request for another page, keeping any other query params
+func (p *Paginator) pageURL(page Page, data cursorData) string {
+	query := url.Values{}
+	if page.url != nil {
+		query = page.url.Query()
+	}
+
+	query.Del("cursor")
+	query.Del("offset")
+	query.Set("limit", strconv.Itoa(page.Limit))
+
+	if page.cursor || data.After != "" {
+		if data.Offset > 0 || data.After != "" {
+			query.Set("cursor", p.encodeCursor(data))
+		}
+	} else if data.Offset > 0 {
+		query.Set("offset", strconv.Itoa(data.Offset))
+	}
+
+	path := ""
+	if page.url != nil {
+		path = page.url.Path
+	}
+
+	return path + "?" + query.Encode()
+}
+
+// encodeCursor makes an opaque cursor, the payload followed by a HMAC signature
+func (p *Paginator) encodeCursor(data cursorData) string {
+	payload, _ := json.Marshal(data)
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// decodeCursor checks the signature of a cursor and returns its contents
+func (p *Paginator) decodeCursor(cursor string) (cursorData, error) {
+	data := cursorData{}
+	errInvalid := errors.New("is invalid or has been tampered with")
+
+	payloadPart, sigPart, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return data, errInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(payloadPart)
+	if err != nil {
+		return data, errInvalid
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(sigPart)
+	if err != nil {
+		return data, errInvalid
+	}
+
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(payload)
+
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return data, errInvalid
+	}
+
+	if err := json.Unmarshal(payload, &data); err != nil || data.Offset < 0 {
+		return data, errInvalid
+	}
+
+	return data, nil
+}
+
+// Sparse fieldsets select from the items, not the envelope, see QuerySpec
+func (env PageEnvelope[T]) envelopeItems() string {
+	return "items"
+}
+
+func (env PageEnvelope[T]) unwrapItems() any {
+	return env.Items
+}
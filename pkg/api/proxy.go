@@ -0,0 +1,230 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Client address, scheme & host from trusted reverse proxies only
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Headers proxies use to pass on details of the client, removed from requests that don't come from a trusted proxy
+var forwardedHeaders = []string{
+	"Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Real-IP", "True-Client-IP",
+}
+
+// TrustedProxies replaces RemoteAddr, and the URL scheme & host, with the values passed on by trusted proxies
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// NewTrustedProxies creates the middleware from a list of CIDRs or single IPs, e.g. "10.0.0.0/8" or "127.0.0.1"
+// With an empty list no proxies are trusted, and the forwarded headers are always removed
+func NewTrustedProxies(cidrs ...string) (*TrustedProxies, error) {
+	tp := &TrustedProxies{}
+
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s': %w", cidr, err)
+			}
+
+			tp.prefixes = append(tp.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %w", cidr, err)
+		}
+
+		tp.prefixes = append(tp.prefixes, prefix.Masked())
+	}
+
+	return tp, nil
+}
+
+// Middleware honours the Forwarded (RFC 7239) header, or X-Forwarded-For, -Proto & -Host when it's missing,
+// but only when the request comes from a trusted proxy. The chain of addresses is walked back from the nearest
+// proxy, the client is the first address that isn't trusted, so clients can't spoof their address by sending
+// the headers themselves. Requests from anyone else have the headers removed, so they can't be relied on later
+func (tp *TrustedProxies) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := parseHostAddr(r.RemoteAddr)
+		if !ok || !tp.trusted(peer) {
+			for _, h := range forwardedHeaders {
+				r.Header.Del(h)
+			}
+
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		hops := parseForwarded(r.Header.Values("Forwarded"))
+		if len(hops) == 0 {
+			hops = parseXForwarded(r.Header)
+		}
+
+		// Walk back from the nearest proxy, stopping at the first hop that isn't a trusted proxy
+		var client *forwardedHop
+
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, ok := parseHostAddr(hops[i].forAddr)
+			if !ok {
+				// Obfuscated or unknown, nothing further back can be trusted
+				break
+			}
+
+			client = &hops[i]
+			client.addr = addr
+
+			if !tp.trusted(addr) {
+				break
+			}
+		}
+
+		if client != nil {
+			r.RemoteAddr = client.addr.String()
+
+			if client.proto == "http" || client.proto == "https" {
+				r.URL.Scheme = client.proto
+			}
+
+			if client.host != "" {
+				r.Host = client.host
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (tp *TrustedProxies) trusted(addr netip.Addr) bool {
+	for _, prefix := range tp.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsHTTPS reports if the client connected with HTTPS, directly or to a trusted proxy
+func IsHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.URL.Scheme == "https"
+}
+
+// forwardedHop is the client or a proxy, as passed on by the next proxy along
+type forwardedHop struct {
+	forAddr string
+	proto   string
+	host    string
+	addr    netip.Addr
+}
+
+// parseForwarded parses RFC 7239 Forwarded headers into hops, nearest proxy last
+func parseForwarded(values []string) []forwardedHop {
+	hops := []forwardedHop{}
+
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			hop := forwardedHop{}
+
+			for _, pair := range splitQuoted(element, ';') {
+				name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+
+				val = strings.Trim(strings.TrimSpace(val), `"`)
+
+				switch strings.ToLower(strings.TrimSpace(name)) {
+				case "for":
+					hop.forAddr = val
+				case "proto":
+					hop.proto = strings.ToLower(val)
+				case "host":
+					hop.host = val
+				}
+			}
+
+			hops = append(hops, hop)
+		}
+	}
+
+	return hops
+}
+
+// parseXForwarded turns X-Forwarded-For, -Proto & -Host into hops, nearest proxy last
+// Proto & host are only known per hop when proxies have appended to them too, otherwise the
+// nearest proxy's values are used for every hop
+func parseXForwarded(h http.Header) []forwardedHop {
+	addrs := splitList(strings.Join(h.Values("X-Forwarded-For"), ","))
+	protos := splitList(strings.Join(h.Values("X-Forwarded-Proto"), ","))
+	hosts := splitList(strings.Join(h.Values("X-Forwarded-Host"), ","))
+
+	hops := make([]forwardedHop, len(addrs))
+
+	for i, addr := range addrs {
+		hops[i].forAddr = addr
+		hops[i].proto = strings.ToLower(pickHop(protos, i, len(addrs)))
+		hops[i].host = pickHop(hosts, i, len(addrs))
+	}
+
+	return hops
+}
+
+func pickHop(values []string, i int, hops int) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	if len(values) == hops {
+		return values[i]
+	}
+
+	return values[len(values)-1]
+}
+
+// splitQuoted splits on sep, ignoring any inside quoted strings
+func splitQuoted(s string, sep rune) []string {
+	parts := []string{}
+	quoted := false
+	start := 0
+
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// parseHostAddr gets the IP from an address with an optional port, including RFC 7239's bracketed IPv6
+func parseHostAddr(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
@@ -0,0 +1,534 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Filtering, sorting and sparse fieldset query language for list endpoints
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+)
+
+// FieldKind is the type of a filterable field, it decides which operators & values are allowed
+type FieldKind int
+
+const (
+	StringField FieldKind = iota
+	NumberField
+	BoolField
+)
+
+// QuerySpec is the allow-list of fields that can be used when querying a resource
+type QuerySpec struct {
+	// Fields that can be used in ?filter= and their kinds
+	Filterable map[string]FieldKind
+
+	// Fields that can be used in ?sort=
+	Sortable []string
+
+	// Fields that can be selected with ?fields=
+	Selectable []string
+}
+
+// ListQuery is the parsed & validated filter, sort and fields of a request
+type ListQuery struct {
+	// Nil when no filter was given
+	Filter FilterExpr
+
+	Sort   []SortField
+	Fields []string
+}
+
+// SortField is a field to sort by, in order of precedence
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// FilterExpr is a node in the filter AST, one of Comparison, Logical or Not
+type FilterExpr interface {
+	// Match evaluates the filter, get returns the value of a field for the item being checked
+	Match(get func(field string) any) bool
+}
+
+// Comparison checks a field against a value, e.g. name eq 'cheese'
+// Value is a string, float64 or bool depending on the kind of the field
+// String comparisons are case sensitive, apart from contains & startswith which are searches so ignore case
+type Comparison struct {
+	Field string
+	Op    string
+	Value any
+}
+
+// Logical joins two expressions with "and" or "or"
+type Logical struct {
+	Op    string
+	Left  FilterExpr
+	Right FilterExpr
+}
+
+// Not negates an expression
+type Not struct {
+	Expr FilterExpr
+}
+
+// Operators allowed for each kind of field
+var filterOperators = map[FieldKind][]string{
+	StringField: {"eq", "ne", "gt", "ge", "lt", "le", "contains", "startswith"},
+	NumberField: {"eq", "ne", "gt", "ge", "lt", "le"},
+	BoolField:   {"eq", "ne"},
+}
+
+type listQueryKey struct{}
+
+// Parse reads ?filter=, ?sort= and ?fields= from the request and checks them against the spec
+// The filter syntax is comparisons of the form `field op value` joined with and, or, not & parentheses
+// Strings are single quoted, e.g. `name contains 'toast' and (price lt 5 or vegan eq true)`
+func (s QuerySpec) Parse(r *http.Request) (ListQuery, *problem.Problem) {
+	query := r.URL.Query()
+	lq := ListQuery{}
+	invalid := []problem.InvalidParam{}
+
+	if filter := query.Get("filter"); filter != "" {
+		expr, err := parseFilter(filter, s.Filterable)
+		if err != nil {
+			invalid = append(invalid, problem.InvalidParam{Name: "filter", Reason: err.Error()})
+		}
+
+		lq.Filter = expr
+	}
+
+	for _, field := range splitList(query.Get("sort")) {
+		sf := SortField{Field: strings.TrimPrefix(field, "+")}
+		if name, ok := strings.CutPrefix(field, "-"); ok {
+			sf = SortField{Field: name, Descending: true}
+		}
+
+		if !slices.Contains(s.Sortable, sf.Field) {
+			invalid = append(invalid, problem.InvalidParam{
+				Name:   "sort",
+				Reason: fmt.Sprintf("can not sort by '%s', allowed fields are: %s", sf.Field, strings.Join(s.Sortable, ", ")),
+			})
+		}
+
+		lq.Sort = append(lq.Sort, sf)
+	}
+
+	for _, field := range splitList(query.Get("fields")) {
+		if !slices.Contains(s.Selectable, field) {
+			invalid = append(invalid, problem.InvalidParam{
+				Name:   "fields",
+				Reason: fmt.Sprintf("unknown field '%s', allowed fields are: %s", field, strings.Join(s.Selectable, ", ")),
+			})
+		}
+
+		lq.Fields = append(lq.Fields, field)
+	}
+
+	if len(invalid) > 0 {
+		return lq, invalidProblem(r, invalid)
+	}
+
+	return lq, nil
+}
+
+// Middleware parses the query for every request, sending a 400 problem if it's invalid
+// The result is put in the context, see ListQueryFrom, and JSON responses are pruned to the selected fields,
+// other formats such as CSV & XML can't always represent a partial item so are sent in full
+func (s QuerySpec) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lq, prob := s.Parse(r)
+		if prob != nil {
+			prob.SendWithRequest(w, r)
+			return
+		}
+
+		if len(lq.Fields) > 0 {
+			w = &fieldsWriter{ResponseWriter: w, fields: lq.Fields}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listQueryKey{}, lq)))
+	})
+}
+
+// ListQueryFrom returns the query parsed by QuerySpec.Middleware, or an empty one
+func ListQueryFrom(ctx context.Context) ListQuery {
+	lq, _ := ctx.Value(listQueryKey{}).(ListQuery)
+	return lq
+}
+
+// Match returns true when the item matches the filter, or there is no filter
+func (lq ListQuery) Match(get func(field string) any) bool {
+	return lq.Filter == nil || lq.Filter.Match(get)
+}
+
+func (c Comparison) Match(get func(field string) any) bool {
+	value := get(c.Field)
+
+	switch expected := c.Value.(type) {
+	case string:
+		actual := fmt.Sprint(value)
+
+		switch c.Op {
+		case "contains":
+			return strings.Contains(strings.ToLower(actual), strings.ToLower(expected))
+		case "startswith":
+			return strings.HasPrefix(strings.ToLower(actual), strings.ToLower(expected))
+		default:
+			return compareOp(c.Op, strings.Compare(actual, expected))
+		}
+	case float64:
+		actual, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+		if err != nil {
+			return false
+		}
+
+		switch {
+		case actual < expected:
+			return compareOp(c.Op, -1)
+		case actual > expected:
+			return compareOp(c.Op, 1)
+		default:
+			return compareOp(c.Op, 0)
+		}
+	case bool:
+		actual, ok := value.(bool)
+		return ok && (actual == expected) == (c.Op == "eq")
+	}
+
+	return false
+}
+
+func (l Logical) Match(get func(field string) any) bool {
+	if l.Op == "and" {
+		return l.Left.Match(get) && l.Right.Match(get)
+	}
+
+	return l.Left.Match(get) || l.Right.Match(get)
+}
+
+func (n Not) Match(get func(field string) any) bool {
+	return !n.Expr.Match(get)
+}
+
+func compareOp(op string, cmp int) bool {
+	switch op {
+	case "eq":
+		return cmp == 0
+	case "ne":
+		return cmp != 0
+	case "gt":
+		return cmp > 0
+	case "ge":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	case "le":
+		return cmp <= 0
+	}
+
+	return false
+}
+
+func splitList(value string) []string {
+	items := []string{}
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// ----------------------------------------------------------------------------
+// Filter tokenizer & recursive descent parser
+// ----------------------------------------------------------------------------
+
+type token struct {
+	kind  string // ident, string, number, lparen, rparen, eof
+	text  string
+	value any
+	pos   int
+}
+
+type filterParser struct {
+	tokens []token
+	pos    int
+	fields map[string]FieldKind
+	depth  int
+}
+
+// Limits on filters, so a crafted one can't use unbounded memory & stack when parsed
+const (
+	maxFilterLength = 2000
+	maxFilterDepth  = 20
+)
+
+func parseFilter(filter string, fields map[string]FieldKind) (FilterExpr, error) {
+	if len(filter) > maxFilterLength {
+		return nil, fmt.Errorf("must be no more than %d characters", maxFilterLength)
+	}
+
+	tokens, err := tokenize(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens, fields: fields}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != "eof" {
+		return nil, fmt.Errorf("unexpected '%s' at position %d", tok.text, tok.pos)
+	}
+
+	return expr, nil
+}
+
+func tokenize(input string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')':
+			kind := "lparen"
+			if c == ')' {
+				kind = "rparen"
+			}
+
+			tokens = append(tokens, token{kind: kind, text: string(c), pos: i})
+			i++
+		case c == '\'':
+			// Quoted string, a doubled quote is an escaped quote
+			start := i
+			sb := strings.Builder{}
+			i++
+
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated string at position %d", start)
+				}
+
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						sb.WriteRune('\'')
+						i += 2
+
+						continue
+					}
+
+					i++
+
+					break
+				}
+
+				sb.WriteRune(runes[i])
+				i++
+			}
+
+			tokens = append(tokens, token{kind: "string", text: string(runes[start:i]), value: sb.String(), pos: start})
+		case c == '-' || c == '.' || unicode.IsDigit(c):
+			start := i
+			for i < len(runes) && (runes[i] == '-' || runes[i] == '.' || runes[i] == 'e' || unicode.IsDigit(runes[i])) {
+				i++
+			}
+
+			text := string(runes[start:i])
+
+			n, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number '%s' at position %d", text, start)
+			}
+
+			tokens = append(tokens, token{kind: "number", text: text, value: n, pos: start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) ||
+				runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+
+			tokens = append(tokens, token{kind: "ident", text: string(runes[start:i]), pos: start})
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' at position %d", c, i)
+		}
+	}
+
+	return append(tokens, token{kind: "eof", text: "end of filter", pos: len(runes)}), nil
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != "eof" {
+		p.pos++
+	}
+
+	return tok
+}
+
+func (p *filterParser) isKeyword(word string) bool {
+	tok := p.peek()
+	return tok.kind == "ident" && strings.EqualFold(tok.text, word)
+}
+
+func (p *filterParser) parseOr() (FilterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("or") {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = Logical{Op: "or", Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (FilterExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("and") {
+		p.next()
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = Logical{Op: "and", Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (FilterExpr, error) {
+	// Each not & parenthesis recurses, so nesting is limited
+	p.depth++
+	defer func() { p.depth-- }()
+
+	if p.depth > maxFilterDepth {
+		return nil, fmt.Errorf("is nested more than %d levels deep at position %d", maxFilterDepth, p.peek().pos)
+	}
+
+	if p.isKeyword("not") {
+		p.next()
+
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return Not{Expr: expr}, nil
+	}
+
+	if p.peek().kind == "lparen" {
+		p.next()
+
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if tok := p.next(); tok.kind != "rparen" {
+			return nil, fmt.Errorf("expected ')' at position %d but got '%s'", tok.pos, tok.text)
+		}
+
+		return expr, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (FilterExpr, error) {
+	fieldTok := p.next()
+	if fieldTok.kind != "ident" {
+		return nil, fmt.Errorf("expected a field name at position %d but got '%s'", fieldTok.pos, fieldTok.text)
+	}
+
+	kind, ok := p.fields[fieldTok.text]
+	if !ok {
+		return nil, fmt.Errorf("can not filter by '%s', allowed fields are: %s", fieldTok.text, sortedKeys(p.fields))
+	}
+
+	opTok := p.next()
+	op := strings.ToLower(opTok.text)
+
+	if opTok.kind != "ident" || !slices.Contains(filterOperators[kind], op) {
+		return nil, fmt.Errorf("operator '%s' at position %d is not valid for field '%s', use one of: %s",
+			opTok.text, opTok.pos, fieldTok.text, strings.Join(filterOperators[kind], ", "))
+	}
+
+	valueTok := p.next()
+
+	var value any
+
+	switch {
+	case kind == StringField && valueTok.kind == "string":
+		value = valueTok.value
+	case kind == NumberField && valueTok.kind == "number":
+		value = valueTok.value
+	case kind == BoolField && valueTok.kind == "ident" && (valueTok.text == "true" || valueTok.text == "false"):
+		value = valueTok.text == "true"
+	default:
+		return nil, fmt.Errorf("value '%s' at position %d is not a valid %s for field '%s'",
+			valueTok.text, valueTok.pos, kind, fieldTok.text)
+	}
+
+	return Comparison{Field: fieldTok.text, Op: op, Value: value}, nil
+}
+
+func sortedKeys(m map[string]FieldKind) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	return strings.Join(keys, ", ")
+}
+
+func (k FieldKind) String() string {
+	switch k {
+	case StringField:
+		return "quoted string"
+	case NumberField:
+		return "number"
+	default:
+		return "boolean"
+	}
+}
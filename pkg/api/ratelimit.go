@@ -0,0 +1,302 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Rate limiting middleware, with token bucket & sliding window algorithms
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benc-uk/go-rest-api/pkg/auth"
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+	"github.com/go-chi/chi/v5"
+)
+
+// RateLimitAlgorithm decides how requests are counted
+type RateLimitAlgorithm int
+
+const (
+	// TokenBucket allows bursts up to the limit, refilling steadily over the window
+	TokenBucket RateLimitAlgorithm = iota
+
+	// SlidingWindow counts requests in the last window, weighting the previous window to smooth the edges
+	SlidingWindow
+)
+
+// RateLimit is the number of requests allowed per window
+type RateLimit struct {
+	Requests  int
+	Window    time.Duration
+	Algorithm RateLimitAlgorithm
+}
+
+// RateLimitResult is the outcome of counting a request against a limit
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+
+	// Time until the limit is fully reset
+	Reset time.Duration
+
+	// Time until another request will be allowed, zero if one would be now
+	RetryAfter time.Duration
+}
+
+// RateLimitStore holds rate limit state, implement it to share limits between replicas, e.g. with Redis
+// Take must count the request & check the limit atomically, so the algorithms are run by the store
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// KeyFunc picks the client a request is counted against, returning "" when it can't
+type KeyFunc func(r *http.Request) string
+
+// RateLimiter limits requests per client, see NewRateLimiter
+type RateLimiter struct {
+	Limit RateLimit
+	Store RateLimitStore
+	Key   KeyFunc
+}
+
+// NewRateLimiter creates a rate limiter with an in memory store
+// Requests are counted by the key, falling back to the client IP when the key func returns ""
+func NewRateLimiter(limit RateLimit, key KeyFunc) *RateLimiter {
+	return &RateLimiter{
+		Limit: limit,
+		Store: NewMemoryRateLimitStore(),
+		Key:   key,
+	}
+}
+
+// KeyByIP counts requests by client IP, use it after middleware that sets RemoteAddr from trusted proxies
+func KeyByIP() KeyFunc {
+	return func(r *http.Request) string {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+
+		return host
+	}
+}
+
+// KeyByHeader counts requests by the value of a header, e.g. an API key
+// The value must be checked by earlier middleware, such as a validator rejecting unknown API keys, otherwise
+// a client can send a new value with each request to get a fresh limit every time. For unverified headers
+// also add a limiter using KeyByIP, so there's a limit clients can't get around
+func KeyByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// KeyByClaim counts requests by a string claim of the verified principal, e.g. "sub" or a nested path
+// It must be used after an auth validator, see auth.PrincipalFrom
+func KeyByClaim(path ...string) KeyFunc {
+	return func(r *http.Request) string {
+		value, _ := auth.Claim[string](auth.PrincipalFrom(r.Context()), path...)
+		return value
+	}
+}
+
+// Middleware limits requests, sending a 429 problem when over the limit
+// RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset & RateLimit-Policy headers are sent on every response,
+// and Retry-After when the client has to wait before its next request
+// Used with chi's With on a route the limit is separate for that route, used on a router it covers all of them
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := ""
+		if rl.Key != nil {
+			client = rl.Key(r)
+		}
+
+		if client == "" {
+			client = KeyByIP()(r)
+		}
+
+		// Inline middleware runs after routing, so the route is known and gets its own count
+		route := "*"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = r.Method + " " + rctx.RoutePattern()
+		}
+
+		result, err := rl.Store.Take(r.Context(), route+"|"+client, rl.Limit, time.Now())
+		if err != nil {
+			// Better to let requests through than fail them all when the store is down
+			log.Printf("### ⚠️ API: rate limit store failed, allowing request: %s", err)
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rl.Limit.Requests, ceilSeconds(rl.Limit.Window)))
+
+		if result.RetryAfter > 0 {
+			h.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		}
+
+		if !result.Allowed {
+			problem.New(problemType(http.StatusTooManyRequests), http.StatusText(http.StatusTooManyRequests),
+				http.StatusTooManyRequests, fmt.Sprintf("rate limit of %d requests per %s exceeded, retry in %ds",
+					rl.Limit.Requests, rl.Limit.Window, ceilSeconds(result.RetryAfter)), r.RequestURI).SendWithRequest(w, r)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MemoryRateLimitStore is a RateLimitStore for a single replica, expired entries are removed as it goes
+type MemoryRateLimitStore struct {
+	sync.Mutex
+	entries   map[string]*rateLimitEntry
+	lastSweep time.Time
+}
+
+type rateLimitEntry struct {
+	// Token bucket
+	tokens float64
+	last   time.Time
+
+	// Sliding window
+	windowStart time.Time
+	current     int
+	previous    int
+
+	expires time.Time
+}
+
+// How often expired entries are removed from the memory store
+const rateLimitSweepInterval = time.Minute
+
+// NewMemoryRateLimitStore creates an empty in memory store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		entries: map[string]*rateLimitEntry{},
+	}
+}
+
+// Take implements RateLimitStore
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit,
+	now time.Time) (RateLimitResult, error) {
+	if limit.Requests <= 0 || limit.Window <= 0 {
+		return RateLimitResult{}, fmt.Errorf("invalid rate limit of %d per %s", limit.Requests, limit.Window)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if now.Sub(s.lastSweep) > rateLimitSweepInterval {
+		for k, e := range s.entries {
+			if now.After(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+
+		s.lastSweep = now
+	}
+
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &rateLimitEntry{tokens: float64(limit.Requests), last: now, windowStart: now.Truncate(limit.Window)}
+		s.entries[key] = entry
+	}
+
+	// Nothing is kept for longer than two windows, by then the limit has fully reset
+	entry.expires = now.Add(2 * limit.Window)
+
+	if limit.Algorithm == SlidingWindow {
+		return entry.slidingWindow(limit, now), nil
+	}
+
+	return entry.tokenBucket(limit, now), nil
+}
+
+func (e *rateLimitEntry) tokenBucket(limit RateLimit, now time.Time) RateLimitResult {
+	capacity := float64(limit.Requests)
+	perToken := limit.Window / time.Duration(limit.Requests)
+
+	// Refill for the time since the last request
+	e.tokens = math.Min(capacity, e.tokens+float64(now.Sub(e.last))/float64(perToken))
+	e.last = now
+
+	result := RateLimitResult{Limit: limit.Requests}
+
+	if e.tokens >= 1 {
+		e.tokens--
+		result.Allowed = true
+	}
+
+	result.Remaining = int(e.tokens)
+	result.Reset = time.Duration((capacity - e.tokens) * float64(perToken))
+
+	if e.tokens < 1 {
+		result.RetryAfter = time.Duration((1 - e.tokens) * float64(perToken))
+	}
+
+	return result
+}
+
+func (e *rateLimitEntry) slidingWindow(limit RateLimit, now time.Time) RateLimitResult {
+	start := now.Truncate(limit.Window)
+
+	// Move the window along, a gap of more than one window means nothing was counted in the previous one
+	switch {
+	case start.Sub(e.windowStart) >= 2*limit.Window:
+		e.previous, e.current = 0, 0
+	case start.After(e.windowStart):
+		e.previous, e.current = e.current, 0
+	}
+
+	e.windowStart = start
+
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(limit.Window)
+	count := func() float64 { return float64(e.previous)*weight + float64(e.current) }
+
+	result := RateLimitResult{Limit: limit.Requests, Reset: limit.Window - elapsed}
+
+	if count()+1 <= float64(limit.Requests) {
+		e.current++
+		result.Allowed = true
+	}
+
+	used := count()
+	result.Remaining = max(0, limit.Requests-int(math.Ceil(used)))
+
+	if used+1 > float64(limit.Requests) {
+		// Wait for the previous window's share to fall enough, otherwise until this window's count,
+		// which becomes the previous one, has fallen enough in the next window
+		need := used + 1 - float64(limit.Requests)
+		if e.previous > 0 && need <= float64(e.previous)*weight {
+			result.RetryAfter = time.Duration(need / float64(e.previous) * float64(limit.Window))
+		} else {
+			into := 1 - float64(limit.Requests-1)/float64(e.current)
+			result.RetryAfter = result.Reset + time.Duration(math.Max(0, into)*float64(limit.Window))
+		}
+	}
+
+	return result
+}
+
+// ceilSeconds rounds up to whole seconds for headers, so clients never retry too early
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
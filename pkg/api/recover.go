@@ -0,0 +1,110 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Panic recovery and not found & method not allowed handlers, all sending problems
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+	"github.com/benc-uk/go-rest-api/pkg/requestid"
+	"github.com/go-chi/chi/v5"
+)
+
+// Methods checked when working out the Allow header of a 405 response
+var allowMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// RecoverMiddleware recovers from panics in handlers, logging the stack and sending a 500 problem
+// The panic value isn't sent to the client, the request ID is logged so the two can be tied together
+func (b *Base) RecoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hr := &hijackRecorder{ResponseWriter: w}
+
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+
+			// Used by net/http to abort a response, it must not be swallowed
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			log.Printf("### 💥 %s API, panic handling %s %s [request %s]: %v\n%s",
+				b.ServiceName, r.Method, r.URL.Path, requestid.FromContext(r.Context()), rec, debug.Stack())
+
+			// Hijacked connections, e.g. WebSockets, belong to the handler, there's no response to send
+			if hr.hijacked {
+				return
+			}
+
+			problem.New(problemType(http.StatusInternalServerError), http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError, "an unexpected error occurred handling the request",
+				r.RequestURI).SendWithRequest(w, r)
+		}()
+
+		next.ServeHTTP(hr, r)
+	})
+}
+
+// hijackRecorder notes when the handler takes over the connection
+type hijackRecorder struct {
+	http.ResponseWriter
+	hijacked bool
+}
+
+func (hr *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(hr.ResponseWriter).Hijack()
+	if err == nil {
+		hr.hijacked = true
+	}
+
+	return conn, rw, err
+}
+
+func (hr *hijackRecorder) Flush() {
+	_ = http.NewResponseController(hr.ResponseWriter).Flush()
+}
+
+func (hr *hijackRecorder) Unwrap() http.ResponseWriter {
+	return hr.ResponseWriter
+}
+
+// AddProblemHandlers sets the not found & method not allowed handlers of the router to send problems
+// The 405 response lists the methods the route does support in the Allow header
+func (b *Base) AddProblemHandlers(r chi.Router) {
+	r.NotFound(func(w http.ResponseWriter, req *http.Request) {
+		problem.New(problemType(http.StatusNotFound), http.StatusText(http.StatusNotFound), http.StatusNotFound,
+			fmt.Sprintf("no route matches '%s'", req.URL.Path), req.RequestURI).SendWithRequest(w, req)
+	})
+
+	r.MethodNotAllowed(func(w http.ResponseWriter, req *http.Request) {
+		allowed := []string{}
+
+		for _, method := range allowMethods {
+			if r.Match(chi.NewRouteContext(), method, req.URL.Path) {
+				allowed = append(allowed, method)
+			}
+		}
+
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+
+		problem.New(problemType(http.StatusMethodNotAllowed), http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed, fmt.Sprintf("method %s is not allowed, use one of: %s",
+				req.Method, strings.Join(allowed, ", ")), req.RequestURI).SendWithRequest(w, req)
+	})
+}
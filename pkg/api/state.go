@@ -0,0 +1,177 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Concurrency safe, tri-state service health with change notifications
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HealthLevel is the overall health of the service
+type HealthLevel int
+
+const (
+	Healthy HealthLevel = iota
+	Degraded
+	Unhealthy
+)
+
+// HealthState is a snapshot of the service health, with the reason and time of the last transition
+type HealthState struct {
+	Level  HealthLevel `json:"level"`
+	Reason string      `json:"reason,omitempty"`
+	Since  time.Time   `json:"since"`
+}
+
+// HealthSubscriber is called when the health state changes
+type HealthSubscriber func(prev HealthState, curr HealthState)
+
+// healthTracker holds the current state, guarded by a mutex as it's read & written from many requests
+type healthTracker struct {
+	sync.RWMutex
+	state       HealthState
+	pinned      bool
+	subscribers []HealthSubscriber
+}
+
+var (
+	healthTransitions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "service_health_transitions_total",
+			Help: "Count of service health state changes",
+		},
+		[]string{"service", "from", "to"},
+	)
+
+	healthLevel = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_health_level",
+			Help: "Current service health, 0 = healthy, 1 = degraded, 2 = unhealthy",
+		},
+		[]string{"service"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(healthTransitions)
+	prometheus.MustRegister(healthLevel)
+}
+
+// Health returns the current health state of the service
+func (b *Base) Health() HealthState {
+	b.state.RLock()
+	defer b.state.RUnlock()
+
+	return b.state.state
+}
+
+// SetHealth changes the health state of the service, setting the same level & reason is a no-op
+// Once the server has begun shutting down the state is pinned as unhealthy and can't be changed
+func (b *Base) SetHealth(level HealthLevel, reason string) {
+	b.setHealth(level, reason, false)
+}
+
+// setHealth changes the health state, and when pin is set stops it being changed again
+func (b *Base) setHealth(level HealthLevel, reason string, pin bool) {
+	b.state.Lock()
+
+	prev := b.state.state
+	pinned := b.state.pinned
+	b.state.pinned = pinned || pin
+
+	if pinned || (prev.Level == level && prev.Reason == reason) {
+		b.state.Unlock()
+		return
+	}
+
+	curr := HealthState{
+		Level:  level,
+		Reason: reason,
+		Since:  time.Now(),
+	}
+	b.state.state = curr
+	subscribers := b.state.subscribers
+
+	b.state.Unlock()
+
+	log.Printf("### %s API: health changed from %s to %s%s", level.emoji(), prev.Level, level, reasonSuffix(reason))
+	healthTransitions.WithLabelValues(b.ServiceName, prev.Level.String(), level.String()).Inc()
+	healthLevel.WithLabelValues(b.ServiceName).Set(float64(level))
+
+	// Called outside of the lock so subscribers are free to read the state
+	for _, sub := range subscribers {
+		sub(prev, curr)
+	}
+}
+
+// OnHealthChange registers a subscriber that is called, in order, whenever the health state changes
+func (b *Base) OnHealthChange(sub HealthSubscriber) {
+	b.state.Lock()
+	defer b.state.Unlock()
+
+	b.state.subscribers = append(b.state.subscribers, sub)
+}
+
+// markStopping sets the service unhealthy and pins it there, called when shutdown begins
+// Setting & pinning happen under one lock, so a concurrent SetHealth can't make it healthy again
+func (b *Base) markStopping() {
+	b.setHealth(Unhealthy, "shutting down", true)
+}
+
+func (l HealthLevel) String() string {
+	switch l {
+	case Healthy:
+		return "healthy"
+	case Degraded:
+		return "degraded"
+	case Unhealthy:
+		return "unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText lets the level be serialized as a string, e.g. in JSON
+func (l HealthLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText parses the string form of a level
+func (l *HealthLevel) UnmarshalText(text []byte) error {
+	for _, level := range []HealthLevel{Healthy, Degraded, Unhealthy} {
+		if level.String() == string(text) {
+			*l = level
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown health level '%s'", text)
+}
+
+func (l HealthLevel) emoji() string {
+	switch l {
+	case Healthy:
+		return "💚"
+	case Degraded:
+		return "💛"
+	default:
+		return "💔"
+	}
+}
+
+func reasonSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+
+	return " (" + reason + ")"
+}
@@ -0,0 +1,199 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Streaming JSON arrays & NDJSON from iterators and channels
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"iter"
+	"net/http"
+	"time"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+)
+
+// MediaTypeNDJSON is newline delimited JSON, one item per line
+const MediaTypeNDJSON = "application/x-ndjson"
+
+// StreamOptions control how often a streamed response is flushed to the client
+type StreamOptions struct {
+	// Flush after this many items, zero means only flush on the interval
+	FlushItems int
+
+	// Flush when this long has passed since the last flush, checked as each item is sent
+	FlushInterval time.Duration
+}
+
+// DefaultStreamOptions are used by Stream
+var DefaultStreamOptions = StreamOptions{
+	FlushItems:    100,
+	FlushInterval: time.Second,
+}
+
+// StreamError is the trailing record sent when a stream fails part way through
+type StreamError struct {
+	Error *problem.Problem `json:"error"`
+}
+
+// Stream sends items as they are produced, as NDJSON when the client accepts it, otherwise as a JSON array
+// If the sequence yields an error the stream ends with a StreamError record, as the status has already been sent
+// Streaming stops when the client disconnects, the error that stopped the stream is returned for logging
+func Stream[T any](w http.ResponseWriter, r *http.Request, seq iter.Seq2[T, error]) error {
+	return StreamWith(w, r, seq, DefaultStreamOptions)
+}
+
+// StreamWith is the same as Stream but with options
+func StreamWith[T any](w http.ResponseWriter, r *http.Request, seq iter.Seq2[T, error], opts StreamOptions) error {
+	ndjson := acceptsNDJSON(r.Header.Get("Accept"))
+	fields := selectedFields(w)
+	rc := http.NewResponseController(w)
+
+	w.Header().Add("Vary", "Accept")
+
+	if ndjson {
+		w.Header().Set("Content-Type", MediaTypeNDJSON)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("["))
+	}
+
+	// Send the headers straight away, so the client knows the stream has started
+	_ = rc.Flush()
+
+	count := 0
+	pending := 0
+	lastFlush := time.Now()
+
+	writeRecord := func(data []byte) error {
+		if !ndjson && count > 0 {
+			data = append([]byte(","), data...)
+		}
+
+		if ndjson {
+			data = append(data, '\n')
+		}
+
+		count++
+
+		_, err := w.Write(data)
+
+		return err
+	}
+
+	var streamErr error
+
+	for item, err := range seq {
+		if ctxErr := r.Context().Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		var data []byte
+		if err == nil {
+			data, err = json.Marshal(item)
+		}
+
+		if err == nil {
+			data, err = pruneFields(item, data, fields)
+		}
+
+		if err != nil {
+			streamErr = err
+			break
+		}
+
+		if err := writeRecord(data); err != nil {
+			// Nearly always because the client has gone away
+			return err
+		}
+
+		pending++
+
+		if (opts.FlushItems > 0 && pending >= opts.FlushItems) ||
+			(opts.FlushInterval > 0 && time.Since(lastFlush) >= opts.FlushInterval) {
+			_ = rc.Flush()
+			pending = 0
+			lastFlush = time.Now()
+		}
+	}
+
+	if streamErr != nil {
+		prob := errorProblem(r, streamErr)
+		if prob.Type == problemType(http.StatusInternalServerError) {
+			prob.Type = "stream-error"
+		}
+
+		data, _ := json.Marshal(StreamError{Error: prob})
+		_ = writeRecord(data)
+	}
+
+	if !ndjson {
+		_, _ = w.Write([]byte("]"))
+	}
+
+	_ = rc.Flush()
+
+	return streamErr
+}
+
+// Items adapts a sequence that can't fail for use with Stream
+func Items[T any](seq iter.Seq[T]) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for item := range seq {
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}
+}
+
+// FromChan adapts channels for use with Stream, items are read until the channel is closed or the context ends
+// The errs channel is optional, any error received on it ends the stream with a StreamError record
+func FromChan[T any](ctx context.Context, items <-chan T, errs <-chan error) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+
+		for {
+			select {
+			case <-ctx.Done():
+				yield(zero, ctx.Err())
+				return
+			case err := <-errs:
+				if err != nil {
+					yield(zero, err)
+					return
+				}
+
+				// A closed error channel is ignored, stop selecting on it
+				errs = nil
+			case item, ok := <-items:
+				if !ok {
+					return
+				}
+
+				if !yield(item, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// acceptsNDJSON checks if NDJSON is preferred over a JSON array
+func acceptsNDJSON(accept string) bool {
+	for _, ar := range parseAccept(accept) {
+		if ar.mediaType == MediaTypeNDJSON || ar.mediaType == "application/jsonl" {
+			return true
+		}
+
+		if mediaTypeMatches(ar.mediaType, "application/json") {
+			return false
+		}
+	}
+
+	return false
+}
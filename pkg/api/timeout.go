@@ -0,0 +1,188 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Per-route timeouts, for handlers and for long lived streaming responses
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+)
+
+// Time allowed to send the response once a route's timeout has passed
+const timeoutWriteGrace = 5 * time.Second
+
+// Timeout gives handlers on a route a context deadline, sending a 503 problem if they haven't finished in time
+// The response is buffered so it can be replaced, use StreamTimeout for streaming routes instead
+// The server's write deadline is moved to match, so routes can be given longer than the server wide WriteTimeout
+// Typed handlers that return the context's error when the deadline passes are sent a 504 problem as usual
+func Timeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			setDeadline(http.NewResponseController(w).SetWriteDeadline, time.Now().Add(timeout+timeoutWriteGrace))
+
+			tw := &timeoutWriter{ResponseWriter: w, header: w.Header().Clone(), status: http.StatusOK}
+			done := make(chan struct{})
+			panicked := make(chan any, 1)
+
+			go func() {
+				defer func() {
+					if rec := recover(); rec != nil {
+						// Keep the handler's stack, it's lost when the panic is raised again below
+						if rec != http.ErrAbortHandler {
+							rec = fmt.Sprintf("%v\n\n%s", rec, debug.Stack())
+						}
+
+						panicked <- rec
+					}
+				}()
+
+				next.ServeHTTP(tw, r.WithContext(ctx))
+				close(done)
+			}()
+
+			select {
+			case rec := <-panicked:
+				// Raised on the request's goroutine, so RecoverMiddleware can handle it
+				panic(rec)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+
+				dst := w.Header()
+				for name, values := range tw.header {
+					dst[name] = values
+				}
+
+				w.WriteHeader(tw.status)
+				_, _ = w.Write(tw.buf.Bytes())
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+
+				tw.timedOut = true
+
+				// The client has gone away, there's no one to send a problem to
+				if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return
+				}
+
+				problem.New(problemType(http.StatusServiceUnavailable), http.StatusText(http.StatusServiceUnavailable),
+					http.StatusServiceUnavailable, fmt.Sprintf("request timed out after %s", timeout),
+					r.RequestURI).SendWithRequest(w, r)
+			}
+		})
+	}
+}
+
+// StreamTimeout is for long lived streaming routes, e.g. SSE, which the server's WriteTimeout would cut off
+// The server's read & write deadlines are cleared, and each write is given writeTimeout instead, so the stream
+// stays open for as long as it's being sent, but a client that stops reading is dropped
+// Pass zero to clear the deadlines with no per write timeout, handlers can also manage their own deadlines
+// with http.ResponseController, all the response writers in this package unwrap to the connection
+func StreamTimeout(writeTimeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rc := http.NewResponseController(w)
+
+			setDeadline(rc.SetReadDeadline, time.Time{})
+			setDeadline(rc.SetWriteDeadline, time.Time{})
+
+			if writeTimeout > 0 {
+				w = &deadlineWriter{ResponseWriter: w, rc: rc, timeout: writeTimeout}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// setDeadline sets or clears a connection deadline, writers that can't set deadlines (e.g. in tests) are skipped
+func setDeadline(set func(time.Time) error, deadline time.Time) {
+	if err := set(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("### ⚠️ API: unable to set connection deadline: %s", err)
+	}
+}
+
+// timeoutWriter buffers the response of a handler with a timeout, so a problem can be sent in its place
+type timeoutWriter struct {
+	http.ResponseWriter
+	mu          sync.Mutex
+	header      http.Header
+	buf         bytes.Buffer
+	status      int
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+
+	tw.status = status
+	tw.wroteHeader = true
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	tw.wroteHeader = true
+
+	return tw.buf.Write(b)
+}
+
+// Flush does nothing, the response is sent once the handler has finished
+func (tw *timeoutWriter) Flush() {}
+
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// deadlineWriter gives each write of a streamed response its own deadline
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (dw *deadlineWriter) Write(b []byte) (int, error) {
+	setDeadline(dw.rc.SetWriteDeadline, time.Now().Add(dw.timeout))
+	return dw.ResponseWriter.Write(b)
+}
+
+func (dw *deadlineWriter) Flush() {
+	setDeadline(dw.rc.SetWriteDeadline, time.Now().Add(dw.timeout))
+	_ = dw.rc.Flush()
+}
+
+func (dw *deadlineWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
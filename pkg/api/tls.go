@@ -0,0 +1,262 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// TLS & mutual TLS support, with certificate hot-reload
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// DefaultCertReloadInterval is how often certificate files are checked for changes
+const DefaultCertReloadInterval = 30 * time.Second
+
+// TLSOptions configures serving over TLS, see StartServerTLS
+type TLSOptions struct {
+	// Paths to the PEM encoded server certificate (chain) and private key
+	CertFile string
+	KeyFile  string
+
+	// Optional path to PEM bundle of CAs, when set clients must present a certificate signed by one of them
+	ClientCAFile string
+
+	// How often the files are checked for changes, defaults to DefaultCertReloadInterval
+	ReloadInterval time.Duration
+}
+
+// TLSStatus holds details of the active server certificate, reported by the status endpoint
+type TLSStatus struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotAfter  time.Time `json:"notAfter"`
+	MutualTLS bool      `json:"mutualTLS"`
+}
+
+// certReloader holds the current certificate & client CA pool, reloading them when the files change
+type certReloader struct {
+	sync.RWMutex
+	opts     TLSOptions
+	cert     *tls.Certificate
+	leaf     *x509.Certificate
+	clientCA *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// StartServerTLS starts the HTTPS server and blocks until it exits, see StartServer
+func (b *Base) StartServerTLS(port int, router chi.Router, timeout time.Duration, opts TLSOptions) error {
+	return b.StartServerTLSContext(context.Background(), port, router, timeout, opts)
+}
+
+// StartServerTLSContext is the same as StartServerTLS but will also shutdown when the context is cancelled
+func (b *Base) StartServerTLSContext(ctx context.Context, port int, router chi.Router,
+	timeout time.Duration, opts TLSOptions) error {
+	reloader, err := newCertReloader(opts)
+	if err != nil {
+		return err
+	}
+
+	b.certs = reloader
+
+	srv := &http.Server{
+		Handler:      router,
+		Addr:         fmt.Sprintf(":%d", port),
+		WriteTimeout: timeout,
+		ReadTimeout:  timeout,
+		IdleTimeout:  timeout,
+		TLSConfig:    reloader.tlsConfig(),
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go reloader.watch(ctx)
+
+	log.Printf("### 🔒 %s API, listening with TLS on port: %d", b.ServiceName, port)
+	log.Printf("### 🚀 Build details: %s (%s)", b.Version, b.BuildInfo)
+
+	return b.run(ctx, srv, func() error {
+		// Certs are supplied by the TLS config so no files are passed here
+		return srv.ListenAndServeTLS("", "")
+	})
+}
+
+// TLSStatus returns details of the active server certificate, or nil when not serving TLS
+func (b *Base) TLSStatus() *TLSStatus {
+	if b.certs == nil {
+		return nil
+	}
+
+	b.certs.RLock()
+	defer b.certs.RUnlock()
+
+	return &TLSStatus{
+		Subject:   b.certs.leaf.Subject.String(),
+		Issuer:    b.certs.leaf.Issuer.String(),
+		NotAfter:  b.certs.leaf.NotAfter,
+		MutualTLS: b.certs.clientCA != nil,
+	}
+}
+
+func newCertReloader(opts TLSOptions) (*certReloader, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errors.New("TLS cert and key files must both be set")
+	}
+
+	if opts.ReloadInterval <= 0 {
+		opts.ReloadInterval = DefaultCertReloadInterval
+	}
+
+	cr := &certReloader{
+		opts:     opts,
+		modTimes: map[string]time.Time{},
+	}
+
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// load reads the cert, key & optional CA bundle from disk and swaps them in
+func (cr *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.opts.CertFile, cr.opts.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS key pair: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing TLS certificate: %w", err)
+	}
+
+	var pool *x509.CertPool
+
+	if cr.opts.ClientCAFile != "" {
+		caBytes, err := os.ReadFile(cr.opts.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("reading client CA bundle: %w", err)
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return fmt.Errorf("no certificates found in client CA bundle %s", cr.opts.ClientCAFile)
+		}
+	}
+
+	cr.Lock()
+	defer cr.Unlock()
+
+	cr.cert = &cert
+	cr.leaf = leaf
+	cr.clientCA = pool
+
+	for _, file := range cr.files() {
+		if info, err := os.Stat(file); err == nil {
+			cr.modTimes[file] = info.ModTime()
+		}
+	}
+
+	return nil
+}
+
+// files returns the list of files being watched
+func (cr *certReloader) files() []string {
+	files := []string{cr.opts.CertFile, cr.opts.KeyFile}
+	if cr.opts.ClientCAFile != "" {
+		files = append(files, cr.opts.ClientCAFile)
+	}
+
+	return files
+}
+
+// changed checks if any of the files have been modified since they were last loaded
+func (cr *certReloader) changed() bool {
+	cr.RLock()
+	defer cr.RUnlock()
+
+	for _, file := range cr.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+
+		if !info.ModTime().Equal(cr.modTimes[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watch polls the files for changes until the context is done
+// Polling is used rather than fsnotify as it copes with the symlink swaps done by Kubernetes secrets
+func (cr *certReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(cr.opts.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !cr.changed() {
+				continue
+			}
+
+			// On failure keep serving with the old cert, files might be mid-rotation
+			if err := cr.load(); err != nil {
+				log.Printf("### 🔒 TLS: Failed to reload certificate, keeping existing one. Error: %s", err)
+				continue
+			}
+
+			cr.RLock()
+			log.Printf("### 🔒 TLS: Reloaded certificate '%s', expires %s", cr.leaf.Subject, cr.leaf.NotAfter)
+			cr.RUnlock()
+		}
+	}
+}
+
+// tlsConfig builds a config that always hands out the current cert and client CA pool
+func (cr *certReloader) tlsConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cr.RLock()
+			defer cr.RUnlock()
+
+			return cr.cert, nil
+		},
+	}
+
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cr.RLock()
+		defer cr.RUnlock()
+
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+
+		if cr.clientCA != nil {
+			cfg.ClientCAs = cr.clientCA
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		return cfg, nil
+	}
+
+	return base
+}
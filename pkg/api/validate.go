@@ -0,0 +1,290 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Declarative struct validation using `validate` tags
+// ----------------------------------------------------------------------------
+
+package api
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+)
+
+var (
+	uuidRegex  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	regexCache = sync.Map{}
+
+	// Result of CheckValidateTags for each type, so the tags are only parsed once
+	checkedTypes = sync.Map{}
+)
+
+// CheckValidateTags parses the `validate` tags of a struct type, including nested structs, and compiles
+// any regex patterns, returning an error for unknown rules or bad arguments. Bind & Handle call this so
+// mistakes in the tags are found when a type is first used rather than when a field is set
+func CheckValidateTags(v any) error {
+	return checkTypeTags(reflect.TypeOf(v))
+}
+
+func checkTypeTags(t reflect.Type) error {
+	if t == nil {
+		return nil
+	}
+
+	if err, ok := checkedTypes.Load(t); ok {
+		if err == nil {
+			return nil
+		}
+
+		return err.(error)
+	}
+
+	err := checkTags(t, map[reflect.Type]bool{})
+	checkedTypes.Store(t, err)
+
+	return err
+}
+
+func checkTags(t reflect.Type, seen map[reflect.Type]bool) error {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct || seen[t] {
+		return nil
+	}
+
+	seen[t] = true
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		if tag, ok := field.Tag.Lookup("validate"); ok {
+			if err := checkRules(tag); err != nil {
+				return fmt.Errorf("field %s of %s: %w", field.Name, t, err)
+			}
+		}
+
+		if err := checkTags(field.Type, seen); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkRules checks each rule in a tag is known and has a valid argument
+func checkRules(tag string) error {
+	for _, rule := range splitRules(tag) {
+		name, arg, _ := strings.Cut(rule, "=")
+
+		switch name {
+		case "required", "email", "uuid", "enum":
+		case "min", "max":
+			if _, err := strconv.ParseFloat(arg, 64); err != nil {
+				return fmt.Errorf("invalid %s rule '%s'", name, arg)
+			}
+		case "regex":
+			if _, err := cachedRegex(arg); err != nil {
+				return fmt.Errorf("invalid regex rule: %w", err)
+			}
+		default:
+			return fmt.Errorf("unknown validation rule '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks a struct against its `validate` tags and returns every invalid field
+// Supported rules, comma separated:
+//   - required: must not be the zero value
+//   - min=N, max=N: numbers by value, strings by length in characters, slices & maps by length
+//   - enum=a|b|c: must be one of the listed values
+//   - email, uuid: must be a valid email address or UUID
+//   - regex=pattern: must match, this must be the last rule as the pattern may contain commas
+//
+// Fields that are not required are only checked when they are set. Nested structs are checked too
+func Validate(v any) []problem.InvalidParam {
+	return validateValue(reflect.ValueOf(v), "")
+}
+
+func validateValue(val reflect.Value, prefix string) []problem.InvalidParam {
+	invalid := []problem.InvalidParam{}
+
+	val = reflect.Indirect(val)
+	if val.Kind() != reflect.Struct {
+		return invalid
+	}
+
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := prefix + fieldName(field, "query", "path", "form")
+		fieldVal := val.Field(i)
+
+		if tag, ok := field.Tag.Lookup("validate"); ok {
+			for _, reason := range validateField(fieldVal, tag) {
+				invalid = append(invalid, problem.InvalidParam{Name: name, Reason: reason})
+			}
+		}
+
+		// Recurse into nested structs and slices of structs
+		inner := reflect.Indirect(fieldVal)
+
+		switch inner.Kind() {
+		case reflect.Struct:
+			invalid = append(invalid, validateValue(inner, name+".")...)
+		case reflect.Slice, reflect.Array:
+			for j := 0; j < inner.Len(); j++ {
+				invalid = append(invalid, validateValue(inner.Index(j), fmt.Sprintf("%s[%d].", name, j))...)
+			}
+		}
+	}
+
+	return invalid
+}
+
+// validateField applies all the rules in a tag to a single field, returning reasons for failures
+func validateField(val reflect.Value, tag string) []string {
+	reasons := []string{}
+	rules := splitRules(tag)
+
+	if val.IsZero() {
+		if slices.Contains(rules, "required") {
+			reasons = append(reasons, "is required")
+		}
+
+		return reasons
+	}
+
+	val = reflect.Indirect(val)
+
+	for _, rule := range rules {
+		name, arg, _ := strings.Cut(rule, "=")
+
+		var reason string
+
+		switch name {
+		case "required":
+			continue
+		case "min", "max":
+			reason = checkBound(val, name, arg)
+		case "enum":
+			if !slices.Contains(strings.Split(arg, "|"), fmt.Sprint(val.Interface())) {
+				reason = "must be one of: " + strings.ReplaceAll(arg, "|", ", ")
+			}
+		case "email":
+			addr, err := mail.ParseAddress(val.String())
+			if err != nil || addr.Address != val.String() {
+				reason = "must be a valid email address"
+			}
+		case "uuid":
+			if !uuidRegex.MatchString(val.String()) {
+				reason = "must be a valid UUID"
+			}
+		case "regex":
+			re, err := cachedRegex(arg)
+			if err != nil {
+				reason = "has invalid regex rule '" + arg + "'"
+			} else if !re.MatchString(val.String()) {
+				reason = "must match pattern " + arg
+			}
+		default:
+			reason = "has unknown validation rule '" + name + "'"
+		}
+
+		if reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+
+	return reasons
+}
+
+// checkBound checks min & max rules, the size depends on the kind of value
+func checkBound(val reflect.Value, rule string, arg string) string {
+	limit, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return "has invalid " + rule + " rule '" + arg + "'"
+	}
+
+	var size float64
+
+	unit := ""
+
+	switch val.Kind() {
+	case reflect.String:
+		size = float64(utf8.RuneCountInString(val.String()))
+		unit = " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		size = float64(val.Len())
+		unit = " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size = float64(val.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		size = float64(val.Uint())
+	case reflect.Float32, reflect.Float64:
+		size = val.Float()
+	default:
+		return "can not be checked with " + rule
+	}
+
+	if rule == "min" && size < limit {
+		return "must be at least " + arg + unit
+	}
+
+	if rule == "max" && size > limit {
+		return "must be at most " + arg + unit
+	}
+
+	return ""
+}
+
+// splitRules splits a tag on commas, but anything after regex= is kept whole
+func splitRules(tag string) []string {
+	rules := []string{}
+
+	for tag = strings.TrimSpace(tag); tag != ""; tag = strings.TrimSpace(tag) {
+		if strings.HasPrefix(tag, "regex=") {
+			return append(rules, tag)
+		}
+
+		rule, rest, _ := strings.Cut(tag, ",")
+		rules = append(rules, strings.TrimSpace(rule))
+		tag = rest
+	}
+
+	return rules
+}
+
+func cachedRegex(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	regexCache.Store(pattern, re)
+
+	return re, nil
+}
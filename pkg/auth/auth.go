@@ -57,26 +57,30 @@ func NewPassthroughValidator() PassthroughValidator {
 }
 
 // Middleware returns middleware to enforce JWT auth on all routes
+// The verified caller is put in the request context, see PrincipalFrom
 func (v JWTValidator) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !validateRequest(r, v.clientID, v.scope, v.jwks) {
+		principal, ok := validateRequest(r, v.clientID, v.scope, v.jwks)
+		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), principal)))
 	})
 }
 
 // Protect can be added around any route handler to enforce JWT auth
+// The verified caller is put in the request context, see PrincipalFrom
 func (v JWTValidator) Protect(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !validateRequest(r, v.clientID, v.scope, v.jwks) {
+		principal, ok := validateRequest(r, v.clientID, v.scope, v.jwks)
+		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), principal)))
 	}
 }
 
@@ -94,56 +98,65 @@ func (v PassthroughValidator) Protect(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// validateRequest is an internal function to validate a request
-func validateRequest(r *http.Request, clientID string, scope string, jwks *keyfunc.JWKS) bool {
+// validateRequest is an internal function to validate a request, returning the caller when it's valid
+func validateRequest(r *http.Request, clientID string, scope string, jwks *keyfunc.JWKS) (*Principal, bool) {
 	// Get auth header & bearer scheme
 	authHeader := r.Header.Get("Authorization")
 	if len(authHeader) == 0 {
-		return false
+		return nil, false
 	}
 
 	// Split header into scheme & B64 token	string
 	authParts := strings.Split(authHeader, " ")
 	if len(authParts) != 2 {
-		return false
+		return nil, false
 	}
 
 	if strings.ToLower(authParts[0]) != "bearer" {
-		return false
+		return nil, false
 	}
 
 	// JWKS might not have been fetched or some other error with it, if not then deny access
 	if jwks == nil {
 		log.Printf("### 🔐 Auth: No JWKS, cannot validate token, denying access")
-		return false
+		return nil, false
 	}
 
 	// Parse the JWT string using the key fetched from the JWKS
 	token, err := jwt.Parse(authParts[1], jwks.Keyfunc)
 	if err != nil {
 		log.Printf("### 🔐 Auth: Failed to parse the JWT. Error: %s", err)
-		return false
+		return nil, false
 	}
 
-	claims := token.Claims.(jwt.MapClaims)
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, false
+	}
+
+	principal := NewPrincipal(claims)
 
 	// Check the scope includes the app scope
-	if !strings.Contains(claims["scp"].(string), scope) {
-		log.Printf("### 🔐 Auth: Scope '%s' is missing from token scope '%s'", scope, claims["scp"])
-		return false
+	if scope != "" && !principal.HasScope(scope) {
+		log.Printf("### 🔐 Auth: Scope '%s' is missing from token scopes %v", scope, principal.Scopes)
+		return nil, false
 	}
 
-	// Azure AD returns the audience with a prefix of api:// so we need to remove it
-	audience := claims["aud"]
-	if strings.HasPrefix(audience.(string), "api://") {
-		audience = strings.TrimPrefix(audience.(string), "api://")
+	// The audience can be a string or an array, it needs to include the client id
+	audiences, err := claims.GetAudience()
+	if err != nil {
+		log.Printf("### 🔐 Auth: Invalid token audience. Error: %s", err)
+		return nil, false
 	}
 
-	// Check the token audience is the client id, this might have already been done by jwt.Parse
-	if audience != clientID {
-		log.Printf("### 🔐 Auth: Token audience '%s' does not match '%s'", claims["aud"], clientID)
-		return false
+	// Azure AD returns the audience with a prefix of api:// so we need to remove it
+	for _, audience := range audiences {
+		if strings.TrimPrefix(audience, "api://") == clientID {
+			return principal, true
+		}
 	}
 
-	return true
+	log.Printf("### 🔐 Auth: Token audience %v does not match '%s'", audiences, clientID)
+
+	return nil, false
 }
@@ -0,0 +1,193 @@
+// --------------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Principal, the verified caller of a request, and typed claim lookup
+// --------------------------------------------------------------------------------
+
+package auth
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Principal is the caller of a request, put in the context by the validators once the token has been verified
+type Principal struct {
+	// From the sub claim
+	Subject string
+
+	// From the tid claim (Entra ID), or tenant_id or tenant
+	Tenant string
+
+	// From the scp claim (Entra ID) or scope, either space separated or an array
+	Scopes []string
+
+	// From the roles claim
+	Roles []string
+
+	// All the claims of the token, look them up with Claim
+	Claims map[string]any
+}
+
+type principalKey struct{}
+
+// Claims the tenant is read from, first found is used
+var tenantClaims = []string{"tid", "tenant_id", "tenant"}
+
+// NewPrincipal creates a principal from the claims of a verified token
+func NewPrincipal(claims map[string]any) *Principal {
+	p := &Principal{Claims: claims}
+
+	p.Subject, _ = Claim[string](p, "sub")
+
+	for _, name := range tenantClaims {
+		if tenant, ok := Claim[string](p, name); ok && tenant != "" {
+			p.Tenant = tenant
+			break
+		}
+	}
+
+	if scopes, ok := Claim[[]string](p, "scp"); ok {
+		p.Scopes = scopes
+	} else {
+		p.Scopes, _ = Claim[[]string](p, "scope")
+	}
+
+	p.Roles, _ = Claim[[]string](p, "roles")
+
+	return p
+}
+
+// NewContext returns a copy of the context holding the principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal of the request, or nil when the request wasn't authenticated
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// HasScope reports if the principal was granted the scope
+func (p *Principal) HasScope(scope string) bool {
+	return p != nil && slices.Contains(p.Scopes, scope)
+}
+
+// HasRole reports if the principal has the role
+func (p *Principal) HasRole(role string) bool {
+	return p != nil && slices.Contains(p.Roles, role)
+}
+
+// Claim looks up a claim of the principal as type T, returning false when it's missing or can't be converted
+// The path walks into nested objects by name and into arrays by index, e.g. Claim[string](p, "groups", "0")
+// Supported types are string, bool, int, int64, float64, time.Time (from a NumericDate), []string & map[string]any,
+// a []string can be read from an array of strings or a space separated string, as with scopes
+func Claim[T any](p *Principal, path ...string) (T, bool) {
+	var zero T
+
+	if p == nil || len(path) == 0 {
+		return zero, false
+	}
+
+	var value any = p.Claims
+
+	for _, name := range path {
+		switch v := value.(type) {
+		case map[string]any:
+			next, ok := v[name]
+			if !ok {
+				return zero, false
+			}
+
+			value = next
+		case []any:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(v) {
+				return zero, false
+			}
+
+			value = v[i]
+		default:
+			return zero, false
+		}
+	}
+
+	converted, ok := convertClaim(value, zero)
+	if !ok {
+		return zero, false
+	}
+
+	// Other types, e.g. any, are only returned when the value already has that type
+	t, ok := converted.(T)
+
+	return t, ok
+}
+
+// convertClaim converts a value decoded from JSON to the type of target
+func convertClaim(value any, target any) (any, bool) {
+	switch target.(type) {
+	case string:
+		s, ok := value.(string)
+		return s, ok
+	case bool:
+		b, ok := value.(bool)
+		return b, ok
+	case float64:
+		f, ok := value.(float64)
+		return f, ok
+	case int:
+		f, ok := value.(float64)
+		if !ok || f != math.Trunc(f) {
+			return nil, false
+		}
+
+		return int(f), true
+	case int64:
+		f, ok := value.(float64)
+		if !ok || f != math.Trunc(f) {
+			return nil, false
+		}
+
+		return int64(f), true
+	case time.Time:
+		f, ok := value.(float64)
+		if !ok {
+			return nil, false
+		}
+
+		sec, frac := math.Modf(f)
+
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	case []string:
+		switch v := value.(type) {
+		case string:
+			return strings.Fields(v), true
+		case []any:
+			list := make([]string, 0, len(v))
+
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, false
+				}
+
+				list = append(list, s)
+			}
+
+			return list, true
+		}
+
+		return nil, false
+	case map[string]any:
+		m, ok := value.(map[string]any)
+		return m, ok
+	}
+
+	return value, true
+}
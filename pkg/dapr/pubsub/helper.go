@@ -8,13 +8,18 @@
 package pubsub
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 
+	"github.com/benc-uk/go-rest-api/pkg/env"
 	"github.com/benc-uk/go-rest-api/pkg/problem"
+	"github.com/benc-uk/go-rest-api/pkg/requestid"
+	"github.com/benc-uk/go-rest-api/pkg/trace"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -31,6 +36,9 @@ type CloudEvent struct {
 
 const routeBase = "/dapr/pubsub/receive"
 
+// Client used to call the Dapr sidecar, it forwards the request ID & trace context
+var daprClient = &http.Client{Transport: requestid.Transport{Base: trace.Transport{}}}
+
 // Subscribe is a HTTP handler that lets Dapr know what topics we subscribe to
 func Subscribe(pubSubName string, topics []string, router chi.Router) {
 	log.Printf("### ✉️ DAPR: Subscribing to topics: %s", topics)
@@ -59,6 +67,18 @@ func AddTopicHandler(topic string, router chi.Router, handler func(event *CloudE
 	route := fmt.Sprintf("%s/%s", routeBase, topic)
 
 	router.Post(route, func(resp http.ResponseWriter, req *http.Request) {
+		// Dapr sends the traceparent of the publisher, so the trace carries on through the topic
+		ctx := req.Context()
+		if sc, ok := trace.Extract(req.Header); ok {
+			ctx = trace.ContextWithRemoteSpanContext(ctx, sc)
+		}
+
+		_, span := trace.Start(ctx, "dapr receive "+topic, trace.SpanKindConsumer)
+		defer span.End()
+
+		span.SetAttribute("messaging.system", "dapr")
+		span.SetAttribute("messaging.destination.name", topic)
+
 		// Decode the event
 		event := &CloudEvent{}
 		var bodyBytes []byte
@@ -68,18 +88,62 @@ func AddTopicHandler(topic string, router chi.Router, handler func(event *CloudE
 		err := json.Unmarshal(bodyBytes, &event)
 		if err != nil {
 			// Returning a non-200 will reschedule the received message
-			problem.Wrap(500, req.RequestURI, topic, err).Send(resp)
+			problem.Wrap(500, req.RequestURI, topic, err).SendWithRequest(resp, req)
 		}
 
 		// Log the event
 		log.Printf("### 📩 Received message: %s from pub/sub topic: %s", topic, event.ID)
+		span.SetAttribute("messaging.message.id", event.ID)
 
 		// Pass the body to the handler
 		// It would be really nice to pass the decoded data object/struct but we don't know the type
 		err = handler(event)
 		if err != nil {
-			problem.Wrap(500, req.RequestURI, topic, err).Send(resp)
+			span.SetError(err)
+			problem.Wrap(500, req.RequestURI, topic, err).SendWithRequest(resp, req)
 			return
 		}
 	})
 }
+
+// Publish sends a message to a Dapr pub-sub topic, using the HTTP API of the Dapr sidecar
+// The request ID & trace in the context are forwarded, so the publish can be correlated with the request that made it
+func Publish(ctx context.Context, pubSubName string, topic string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("http://localhost:%d/v1.0/publish/%s/%s", env.GetEnvInt("DAPR_HTTP_PORT", 3500), pubSubName, topic)
+
+	ctx, span := trace.Start(ctx, "dapr publish "+topic, trace.SpanKindProducer)
+	defer span.End()
+
+	span.SetAttribute("messaging.system", "dapr")
+	span.SetAttribute("messaging.destination.name", topic)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := daprClient.Do(req)
+	if err != nil {
+		span.SetError(err)
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(resp.Body)
+		err = fmt.Errorf("publish to %s/%s failed with status %d: %s", pubSubName, topic, resp.StatusCode, detail)
+		span.SetError(err)
+
+		return err
+	}
+
+	return nil
+}
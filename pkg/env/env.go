@@ -10,6 +10,7 @@ package env
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
 // Internal function to fetch environmental variable or return default
@@ -59,3 +60,22 @@ func GetEnvBool(key string, defaultVal bool) bool {
 
 	return defaultVal
 }
+
+// GetEnvList is a simple helper function to read an environment variable
+// as a comma separated list or return a default value.
+func GetEnvList(key string, defaultVal []string) []string {
+	valueStr := getEnv(key, "")
+	if valueStr == "" {
+		return defaultVal
+	}
+
+	list := []string{}
+
+	for _, item := range strings.Split(valueStr, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
@@ -20,13 +20,15 @@ import (
 )
 
 type TestCase struct {
-	Name           string // Name of this test
-	URL            string // URL to test
-	Method         string // HTTP method to use
-	Body           string // Body to send (if POST etc)
-	CheckBody      string // Regex to check for in response body
-	CheckBodyCount int    // Number of times regex should match
-	CheckStatus    int    // Expected HTTP status code
+	Name           string            // Name of this test
+	URL            string            // URL to test
+	Method         string            // HTTP method to use
+	Body           string            // Body to send (if POST etc)
+	Headers        map[string]string // Extra request headers to send (optional)
+	CheckBody      string            // Regex to check for in response body
+	CheckBodyCount int               // Number of times regex should match
+	CheckStatus    int               // Expected HTTP status code
+	CheckHeaders   map[string]string // Regexes to check response headers against (optional)
 }
 
 func Run(t *testing.T, router chi.Router, testCases []TestCase) {
@@ -39,6 +41,10 @@ func Run(t *testing.T, router chi.Router, testCases []TestCase) {
 			req.Header.Set("Content-Type", "application/json")
 			req.Header.Set("Content-Length", strconv.Itoa(len(test.Body)))
 
+			for key, value := range test.Headers {
+				req.Header.Set(key, value)
+			}
+
 			rec := httptest.NewRecorder()
 
 			router.ServeHTTP(rec, req)
@@ -48,6 +54,14 @@ func Run(t *testing.T, router chi.Router, testCases []TestCase) {
 				return
 			}
 
+			for key, pattern := range test.CheckHeaders {
+				value := rec.Result().Header.Get(key)
+				if !regexp.MustCompile(pattern).MatchString(value) {
+					t.Errorf("Header %s '%s' does not match '%s'", key, value, pattern)
+					return
+				}
+			}
+
 			if test.CheckBody != "" {
 				body, _ := io.ReadAll(rec.Result().Body)
 				bodyCheckRegex := regexp.MustCompile(test.CheckBody)
@@ -8,12 +8,14 @@
 package logging
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
 	"time"
 
+	"github.com/benc-uk/go-rest-api/pkg/requestid"
 	"github.com/go-chi/chi/middleware"
 )
 
@@ -29,6 +31,7 @@ func NewFilteredRequestLogger(filterOut *regexp.Regexp) func(next http.Handler)
 
 // FilteredRequestLogger is a copy of the middleware.RequestLogger function
 // - But with a reg-ex to filter & exclude URLs from logging
+// - And logging the request ID, when requestid.Middleware is used before it
 func FilteredRequestLogger(f middleware.LogFormatter, urlRegEx *regexp.Regexp) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
@@ -38,6 +41,11 @@ func FilteredRequestLogger(f middleware.LogFormatter, urlRegEx *regexp.Regexp) f
 				return
 			}
 
+			// The chi log formatters include the request ID when it's held under their key
+			if id := requestid.FromContext(r.Context()); id != "" {
+				r = r.WithContext(context.WithValue(r.Context(), middleware.RequestIDKey, id))
+			}
+
 			entry := f.NewLogEntry(r)
 			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
 
@@ -0,0 +1,275 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Request & response validation middleware driven by an OpenAPI 3 document
+// ----------------------------------------------------------------------------
+
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+// Scheme & host at the start of a server URL, e.g. "https://api.example.com"
+var serverHost = regexp.MustCompile(`^[^/]*//[^/]*`)
+
+// Options controls what the Validator checks
+type Options struct {
+	// Also check responses from handlers against the document, useful in tests
+	// Note. This buffers the whole response so should not be used with streaming routes
+	ValidateResponses bool
+
+	// When set, responses that don't match are replaced with a 500 problem, otherwise they are only logged
+	FailOnInvalidResponse bool
+}
+
+// Validator checks requests, and optionally responses, against an OpenAPI document
+type Validator struct {
+	doc    *openapi3.T
+	router routers.Router
+	opts   Options
+}
+
+// NewValidator creates a Validator from an OpenAPI document in JSON or YAML
+func NewValidator(spec []byte, opts Options) (*Validator, error) {
+	loader := openapi3.NewLoader()
+
+	doc, err := loader.LoadFromData(spec)
+	if err != nil {
+		return nil, fmt.Errorf("loading OpenAPI document: %w", err)
+	}
+
+	return newValidator(doc, opts)
+}
+
+// NewValidatorFromFile creates a Validator from an OpenAPI document file, external refs are allowed
+// The path can be relative or absolute, refs are resolved relative to the document and can only be files
+func NewValidatorFromFile(file string, opts Options) (*Validator, error) {
+	loader := openapi3.NewLoader()
+	loader.IsExternalRefsAllowed = true
+	loader.ReadFromURIFunc = openapi3.ReadFromFile
+
+	doc, err := loader.LoadFromFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("loading OpenAPI document %s: %w", file, err)
+	}
+
+	return newValidator(doc, opts)
+}
+
+// NewValidatorFromFS creates a Validator from an OpenAPI document in a filesystem, e.g. an embed.FS
+// External refs are resolved relative to the document in the same filesystem
+func NewValidatorFromFS(fsys fs.FS, file string, opts Options) (*Validator, error) {
+	loader := openapi3.NewLoader()
+	loader.IsExternalRefsAllowed = true
+	loader.ReadFromURIFunc = func(_ *openapi3.Loader, location *url.URL) ([]byte, error) {
+		// Refs such as "../common.yaml" are joined to the document's path, fs.FS only accepts clean paths
+		return fs.ReadFile(fsys, strings.TrimPrefix(path.Clean(location.Path), "/"))
+	}
+
+	doc, err := loader.LoadFromFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("loading OpenAPI document %s: %w", file, err)
+	}
+
+	return newValidator(doc, opts)
+}
+
+func newValidator(doc *openapi3.T, opts Options) (*Validator, error) {
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+
+	// Routes are matched on the path only, so the servers in the document needn't match the host requests are sent to
+	routeDoc := *doc
+	routeDoc.Servers = routingServers(doc.Servers)
+
+	router, err := gorillamux.NewRouter(&routeDoc)
+	if err != nil {
+		return nil, fmt.Errorf("building routes from OpenAPI document: %w", err)
+	}
+
+	log.Printf("### 📜 OpenAPI: validating requests against '%s' %s", doc.Info.Title, doc.Info.Version)
+
+	return &Validator{
+		doc:    doc,
+		router: router,
+		opts:   opts,
+	}, nil
+}
+
+// Middleware validates requests, invalid ones are rejected with a 400 problem listing all the issues
+// Requests for paths not in the document are passed through untouched
+// Security requirements are not checked, use the auth package for that
+func (v *Validator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := v.router.FindRoute(r)
+		if err != nil {
+			if !errors.Is(err, routers.ErrPathNotFound) {
+				log.Printf("### ⚠️ OpenAPI: %s %s not validated: %s", r.Method, r.URL.Path, err)
+			}
+
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		reqInput := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				MultiError:         true,
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			},
+		}
+
+		if err := openapi3filter.ValidateRequest(r.Context(), reqInput); err != nil {
+			p := problem.New("request-validation", "Request does not match API specification", http.StatusBadRequest,
+				"the request was checked against the OpenAPI document and is invalid", r.RequestURI)
+			p.InvalidParams = invalidParams(err)
+			p.SendWithRequest(w, r)
+
+			return
+		}
+
+		if !v.opts.ValidateResponses {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		respInput := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: reqInput,
+			Status:                 rec.status,
+			Header:                 w.Header(),
+			Options: &openapi3filter.Options{
+				MultiError:            true,
+				IncludeResponseStatus: true,
+			},
+		}
+		respInput.SetBodyBytes(rec.body.Bytes())
+
+		if err := openapi3filter.ValidateResponse(r.Context(), respInput); err != nil {
+			log.Printf("### ⚠️ OpenAPI: response to %s %s does not match spec: %s", r.Method, r.URL.Path, err)
+
+			if v.opts.FailOnInvalidResponse {
+				w.Header().Del("Content-Length")
+				problem.Wrap(500, "response-validation", r.RequestURI, err).SendWithRequest(w, r)
+
+				return
+			}
+		}
+
+		w.WriteHeader(rec.status)
+		_, _ = w.Write(rec.body.Bytes())
+	})
+}
+
+// invalidParams flattens the validation errors into a list of fields & reasons
+func invalidParams(err error) []problem.InvalidParam {
+	params := []problem.InvalidParam{}
+
+	// Not errors.As, as RequestErrors also unwrap to a MultiError and we'd lose the context
+	if multi, ok := err.(openapi3.MultiError); ok {
+		for _, e := range multi {
+			params = append(params, invalidParams(e)...)
+		}
+
+		return params
+	}
+
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		return append(params, problem.InvalidParam{Name: "request", Reason: err.Error()})
+	}
+
+	// Body errors are broken down by schema error, to give the path of each invalid field
+	if reqErr.RequestBody != nil && reqErr.Err != nil {
+		var bodyMulti openapi3.MultiError
+		if !errors.As(reqErr.Err, &bodyMulti) {
+			bodyMulti = openapi3.MultiError{reqErr.Err}
+		}
+
+		for _, e := range bodyMulti {
+			var schemaErr *openapi3.SchemaError
+			if errors.As(e, &schemaErr) {
+				name := strings.Join(append([]string{"body"}, schemaErr.JSONPointer()...), ".")
+				params = append(params, problem.InvalidParam{Name: name, Reason: schemaErr.Reason})
+			} else {
+				params = append(params, problem.InvalidParam{Name: "body", Reason: e.Error()})
+			}
+		}
+
+		return params
+	}
+
+	name := "request"
+	if reqErr.Parameter != nil {
+		name = reqErr.Parameter.In + "." + reqErr.Parameter.Name
+	}
+
+	reason := reqErr.Reason
+	if reqErr.Err != nil {
+		var schemaErr *openapi3.SchemaError
+		if errors.As(reqErr.Err, &schemaErr) {
+			reason = schemaErr.Reason
+		} else if reason == "" {
+			reason = reqErr.Err.Error()
+		}
+	}
+
+	return append(params, problem.InvalidParam{Name: name, Reason: reason})
+}
+
+// recorder buffers a response so it can be checked before being sent
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	return rec.body.Write(b)
+}
+
+// routingServers keeps only the path of each server URL, "https://api.example.com/v1" becomes "/v1"
+func routingServers(servers openapi3.Servers) openapi3.Servers {
+	paths := openapi3.Servers{}
+
+	for _, server := range servers {
+		routed := *server
+		routed.URL = serverHost.ReplaceAllString(server.URL, "")
+
+		if routed.URL == "" {
+			routed.URL = "/"
+		}
+
+		paths = append(paths, &routed)
+	}
+
+	return paths
+}
@@ -14,6 +14,8 @@ import (
 	"log"
 	"net/http"
 	"runtime"
+
+	"github.com/benc-uk/go-rest-api/pkg/requestid"
 )
 
 // Problem in RFC-7807 format
@@ -23,19 +25,60 @@ type Problem struct {
 	Status   int    `json:"status,omitempty"`
 	Detail   string `json:"detail,omitempty"`
 	Instance string `json:"instance,omitempty"`
+
+	// Extension member listing invalid request fields, as per the example in the RFC
+	InvalidParams []InvalidParam `json:"invalidParams,omitempty"`
+
+	// Extension member with the ID of the request, so errors can be matched with the server logs
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// InvalidParam describes a single invalid request field or parameter and why
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
 }
 
 // New creates a RFC 7807 problem object
 func New(typeStr string, title string, status int, detail, instance string) *Problem {
-	return &Problem{typeStr, title, status, detail, instance}
+	return &Problem{
+		Type:     typeStr,
+		Title:    title,
+		Status:   status,
+		Detail:   detail,
+		Instance: instance,
+	}
 }
 
 // HTTPSend sends a RFC 7807 problem object as HTTP response
+// The request ID is taken from the response header, as set by requestid.Middleware
+// Prefer SendWithRequest when the request is to hand, the header may have been changed or not set yet
 func (p *Problem) Send(resp http.ResponseWriter) {
-	log.Printf("### 💥 API %s", p.Error())
+	p.SendWithRequest(resp, nil)
+}
+
+// SendWithRequest sends a RFC 7807 problem object as HTTP response
+// The request ID is taken from the request context, falling back to the response header, req can be nil
+// The problem itself isn't changed, so the same one can be sent to many requests
+func (p *Problem) SendWithRequest(resp http.ResponseWriter, req *http.Request) {
+	sent := *p
+
+	if sent.RequestID == "" && req != nil {
+		sent.RequestID = requestid.FromContext(req.Context())
+	}
+
+	if sent.RequestID == "" {
+		sent.RequestID = resp.Header().Get(requestid.Header)
+	}
+
+	if sent.RequestID != "" {
+		log.Printf("### 💥 API %s [request %s]", sent.Error(), sent.RequestID)
+	} else {
+		log.Printf("### 💥 API %s", sent.Error())
+	}
 	resp.Header().Set("Content-Type", "application/json")
-	resp.WriteHeader(p.Status)
-	_ = json.NewEncoder(resp).Encode(p)
+	resp.WriteHeader(sent.Status)
+	_ = json.NewEncoder(resp).Encode(sent)
 }
 
 // Wrap creates a Problem wrapping an error
@@ -0,0 +1,103 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Request ID & correlation, accepted or generated and passed on to other services
+// ----------------------------------------------------------------------------
+
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Header is the HTTP header carrying the request ID
+const Header = "X-Request-ID"
+
+// Incoming IDs longer than this are replaced with a new one
+const maxLength = 128
+
+type contextKey struct{}
+
+// Middleware takes the request ID from the X-Request-ID header, or generates one if it's missing or invalid
+// The ID is put in the request context and echoed in the response header
+// Add it before the request logger and any middleware that sends problems, so they can include it
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !valid(id) {
+			id = New()
+		}
+
+		w.Header().Set(Header, id)
+
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// New generates a random request ID
+func New() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// NewContext returns a copy of the context holding the request ID
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID held in the context, or an empty string
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Transport is a http.RoundTripper that forwards the request ID from the context of outgoing requests
+// Use it in the http.Client for calls to other services, so their logs can be correlated with ours
+type Transport struct {
+	// The transport used to send the request, http.DefaultTransport when nil
+	Base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if id := FromContext(req.Context()); id != "" && req.Header.Get(Header) == "" {
+		// RoundTrippers must not modify the request they are given
+		req = req.Clone(req.Context())
+		req.Header.Set(Header, id)
+	}
+
+	return base.RoundTrip(req)
+}
+
+// NewClient returns a http.Client which forwards request IDs
+func NewClient() *http.Client {
+	return &http.Client{Transport: Transport{}}
+}
+
+// valid checks an incoming ID is a sensible length and only has safe characters
+// so it can't be used to inject into logs
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+
+	for _, c := range id {
+		isAlphaNum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlphaNum && c != '-' && c != '_' && c != '.' && c != ':' && c != '=' && c != '+' && c != '/' {
+			return false
+		}
+	}
+
+	return true
+}
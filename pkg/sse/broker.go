@@ -11,6 +11,8 @@ import (
 	"fmt"
 	"net/http"
 	"slices"
+
+	"github.com/benc-uk/go-rest-api/pkg/trace"
 )
 
 // Struct to hold the broker state
@@ -105,9 +107,15 @@ func (broker *Broker[T]) Stream(clientID string, w http.ResponseWriter, r http.R
 		// Convert the message to SSE format via the adapter
 		sse := broker.MessageAdapter(msg, clientID)
 
+		// Each send is a span, part of the trace of the request that opened the stream
+		_, span := trace.Start(r.Context(), "sse send", trace.SpanKindProducer)
+		span.SetAttribute("sse.event", sse.Event)
+		span.SetAttribute("sse.client_id", clientID)
+
 		// Write and flush immediately as we are streaming data
 		sse.Write(w)
 		w.(http.Flusher).Flush()
+		span.End()
 	}
 }
 
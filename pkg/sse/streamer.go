@@ -10,6 +10,8 @@ package sse
 import (
 	"fmt"
 	"net/http"
+
+	"github.com/benc-uk/go-rest-api/pkg/trace"
 )
 
 type Streamer[T any] struct {
@@ -70,8 +72,13 @@ func (server *Streamer[T]) Stream(w http.ResponseWriter, r http.Request) error {
 		// Convert the message to SSE format via the adapter
 		sse := server.MessageAdapter(msg)
 
+		// Each send is a span, part of the trace of the request that opened the stream
+		_, span := trace.Start(r.Context(), "sse send", trace.SpanKindProducer)
+		span.SetAttribute("sse.event", sse.Event)
+
 		// Write and flush immediately as we are streaming data
 		sse.Write(w)
 		w.(http.Flusher).Flush()
+		span.End()
 	}
 }
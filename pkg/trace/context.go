@@ -0,0 +1,210 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// W3C Trace Context, parsing & propagating the traceparent and tracestate headers
+// See https://www.w3.org/TR/trace-context/
+// ----------------------------------------------------------------------------
+
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+// Max number of list members in tracestate, more than this and the header is dropped
+const maxTracestateMembers = 32
+
+// TraceID identifies a whole trace, across all services
+type TraceID [16]byte
+
+// SpanID identifies a single span within a trace
+type SpanID [8]byte
+
+// SpanContext is the part of a span that is propagated to other services
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+var errInvalidTraceparent = errors.New("invalid traceparent")
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// IsValid is true when both the trace & span IDs are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats the span context as a version 00 traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a traceparent header, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+// Headers from future versions are accepted as long as they start with the version 00 fields
+func ParseTraceparent(value string) (SpanContext, error) {
+	value = strings.TrimSpace(value)
+	if len(value) < 55 {
+		return SpanContext{}, errInvalidTraceparent
+	}
+
+	version, err := hex.DecodeString(value[0:2])
+	if err != nil || version[0] == 0xff || value[0:2] != strings.ToLower(value[0:2]) {
+		return SpanContext{}, errInvalidTraceparent
+	}
+
+	if (version[0] == 0 && len(value) != 55) || (len(value) > 55 && value[55] != '-') {
+		return SpanContext{}, errInvalidTraceparent
+	}
+
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return SpanContext{}, errInvalidTraceparent
+	}
+
+	sc := SpanContext{}
+
+	if !decodeLowerHex(sc.TraceID[:], value[3:35]) || !decodeLowerHex(sc.SpanID[:], value[36:52]) || !sc.IsValid() {
+		return SpanContext{}, errInvalidTraceparent
+	}
+
+	flags := [1]byte{}
+	if !decodeLowerHex(flags[:], value[53:55]) {
+		return SpanContext{}, errInvalidTraceparent
+	}
+
+	sc.Sampled = flags[0]&0x01 == 0x01
+
+	return sc, nil
+}
+
+// Extract reads the span context from the traceparent & tracestate headers
+// false is returned if there is no valid traceparent, in which case tracestate is ignored as well
+func Extract(h http.Header) (SpanContext, bool) {
+	sc, err := ParseTraceparent(h.Get(TraceparentHeader))
+	if err != nil {
+		return SpanContext{}, false
+	}
+
+	// Multiple tracestate headers are combined into one list
+	members := []string{}
+
+	for _, value := range h.Values(TracestateHeader) {
+		for _, member := range strings.Split(value, ",") {
+			if member = strings.TrimSpace(member); member != "" {
+				members = append(members, member)
+			}
+		}
+	}
+
+	if len(members) <= maxTracestateMembers {
+		sc.TraceState = strings.Join(members, ",")
+	}
+
+	return sc, true
+}
+
+// Inject sets the traceparent & tracestate headers from the span in the context, if there is one
+func Inject(ctx context.Context, h http.Header) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+
+	h.Set(TraceparentHeader, sc.Traceparent())
+
+	if sc.TraceState != "" {
+		h.Set(TracestateHeader, sc.TraceState)
+	} else {
+		h.Del(TracestateHeader)
+	}
+}
+
+// ContextWithRemoteSpanContext holds a span context received from another service
+// The next span started with the context becomes its child
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// ContextWithSpan returns a copy of the context with the span as the active span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the active span, or nil if there isn't one
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanContextFromContext returns the span context of the active span, or of a remote parent if there's no active span
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.SpanContext()
+	}
+
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+
+	return sc
+}
+
+// decodeLowerHex decodes hex into dst, only lowercase hex is valid in traceparent
+func decodeLowerHex(dst []byte, src string) bool {
+	if strings.ToLower(src) != src {
+		return false
+	}
+
+	_, err := hex.Decode(dst, []byte(src))
+
+	return err == nil
+}
+
+func newTraceID() TraceID {
+	id := TraceID{}
+	_, _ = rand.Read(id[:])
+
+	return id
+}
+
+func newSpanID() SpanID {
+	id := SpanID{}
+	_, _ = rand.Read(id[:])
+
+	return id
+}
@@ -0,0 +1,93 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Server spans for incoming requests and client spans for outgoing ones
+// ----------------------------------------------------------------------------
+
+package trace
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Middleware starts a server span for each request, continuing the trace from the traceparent header if sent
+// Spans are named after the route pattern, e.g. "GET /things/{id}", so use it on the top level chi router
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if sc, ok := Extract(r.Header); ok {
+			ctx = ContextWithRemoteSpanContext(ctx, sc)
+		}
+
+		ctx, span := Start(ctx, r.Method, SpanKindServer)
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		defer func() {
+			// The route is only known once chi has routed the request
+			route := ""
+			if rctx := chi.RouteContext(ctx); rctx != nil {
+				route = rctx.RoutePattern()
+			}
+
+			if route != "" {
+				span.SetName(r.Method + " " + route)
+				span.SetAttribute("http.route", route)
+			}
+
+			span.SetAttribute("http.request.method", r.Method)
+			span.SetAttribute("url.path", r.URL.Path)
+			span.SetAttribute("http.response.status_code", ww.Status())
+
+			if ww.Status() >= 500 {
+				span.SetStatus(StatusError, http.StatusText(ww.Status()))
+			}
+
+			span.End()
+		}()
+
+		next.ServeHTTP(ww, r.WithContext(ctx))
+	})
+}
+
+// Transport is a http.RoundTripper which starts a client span for each request and sends the traceparent header
+type Transport struct {
+	// The transport used to send the request, http.DefaultTransport when nil
+	Base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	ctx, span := Start(req.Context(), req.Method, SpanKindClient)
+	defer span.End()
+
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("server.address", req.URL.Host)
+	span.SetAttribute("url.full", req.URL.Redacted())
+
+	// RoundTrippers must not modify the request they are given
+	req = req.Clone(ctx)
+	Inject(ctx, req.Header)
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+
+	if resp.StatusCode >= 500 {
+		span.SetStatus(StatusError, resp.Status)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,338 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// OTLP/HTTP exporter, sending batches of spans as JSON to an OpenTelemetry collector
+// See https://opentelemetry.io/docs/specs/otlp/#otlphttp
+// ----------------------------------------------------------------------------
+
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OTLPOptions configure the OTLP exporter, zero values are replaced with the defaults
+type OTLPOptions struct {
+	// Extra headers sent to the collector, e.g. for auth
+	Headers map[string]string
+
+	// Spans are sent when this many are waiting, default 512
+	BatchSize int
+
+	// Max spans waiting to be sent, when full new spans are dropped, default 2048
+	QueueSize int
+
+	// Spans waiting are sent at least this often, default 5 seconds
+	FlushInterval time.Duration
+
+	// Timeout for each request to the collector, default 10 seconds
+	Timeout time.Duration
+}
+
+// OTLPExporter batches spans and sends them to a collector with OTLP/HTTP using JSON encoding
+type OTLPExporter struct {
+	url         string
+	serviceName string
+	opts        OTLPOptions
+	client      *http.Client
+	queue       chan SpanData
+	flushReq    chan chan struct{}
+	stop        chan struct{}
+	stopped     chan struct{}
+	stopOnce    sync.Once
+	dropped     atomic.Int64
+}
+
+// NewOTLPExporter creates an exporter sending to the collector at endpoint, e.g. http://localhost:4318
+// The /v1/traces path is added if it's not already on the endpoint
+func NewOTLPExporter(endpoint string, serviceName string, opts OTLPOptions) *OTLPExporter {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 512
+	}
+
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 2048
+	}
+
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+
+	e := &OTLPExporter{
+		url:         url,
+		serviceName: serviceName,
+		opts:        opts,
+		client:      &http.Client{Timeout: opts.Timeout},
+		queue:       make(chan SpanData, opts.QueueSize),
+		flushReq:    make(chan chan struct{}),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+
+	go e.run()
+
+	return e
+}
+
+// Export queues a span to be sent, if the queue is full the span is dropped rather than blocking
+func (e *OTLPExporter) Export(span SpanData) {
+	select {
+	case e.queue <- span:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// Dropped is the number of spans dropped because the queue was full
+func (e *OTLPExporter) Dropped() int64 {
+	return e.dropped.Load()
+}
+
+// ForceFlush sends all queued spans now, waiting until they've been sent or the context ends
+func (e *OTLPExporter) ForceFlush(ctx context.Context) error {
+	done := make(chan struct{})
+
+	select {
+	case e.flushReq <- done:
+	case <-e.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown sends all queued spans and stops the exporter, spans exported after this are dropped
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.stopOnce.Do(func() {
+		close(e.stop)
+	})
+
+	select {
+	case <-e.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run collects spans into batches, sending them when full, on the interval, or when flushed
+func (e *OTLPExporter) run() {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(e.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, e.opts.BatchSize)
+
+	send := func() {
+		if len(batch) > 0 {
+			e.send(batch)
+			batch = batch[:0]
+		}
+	}
+
+	// Takes everything currently queued, sending full batches as it goes
+	drain := func() {
+		for {
+			select {
+			case span := <-e.queue:
+				batch = append(batch, span)
+				if len(batch) >= e.opts.BatchSize {
+					send()
+				}
+			default:
+				send()
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= e.opts.BatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-e.flushReq:
+			drain()
+			close(done)
+		case <-e.stop:
+			drain()
+			return
+		}
+	}
+}
+
+// send posts a batch of spans to the collector, failures are logged and the spans lost
+func (e *OTLPExporter) send(batch []SpanData) {
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		log.Printf("### ⚠️ Trace: failed to encode spans: %s", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("### ⚠️ Trace: failed to create request: %s", err)
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for key, value := range e.opts.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Printf("### ⚠️ Trace: failed to send %d spans: %s", len(batch), err)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		log.Printf("### ⚠️ Trace: collector rejected %d spans, status %d: %s", len(batch), resp.StatusCode, detail)
+	}
+}
+
+// OTLP JSON encoding, IDs are hex and 64 bit integers are strings
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    StatusCode `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func (e *OTLPExporter) encode(batch []SpanData) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+
+	for _, data := range batch {
+		span := otlpSpan{
+			TraceID:           data.SpanContext.TraceID.String(),
+			SpanID:            data.SpanContext.SpanID.String(),
+			TraceState:        data.SpanContext.TraceState,
+			Name:              data.Name,
+			Kind:              data.Kind,
+			StartTimeUnixNano: strconv.FormatInt(data.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(data.End.UnixNano(), 10),
+			Attributes:        encodeAttributes(data.Attributes),
+			Status:            otlpStatus{Code: data.StatusCode, Message: data.StatusMessage},
+		}
+
+		if data.ParentSpanID.IsValid() {
+			span.ParentSpanID = data.ParentSpanID.String()
+		}
+
+		spans = append(spans, span)
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: encodeAttributes(map[string]any{"service.name": e.serviceName}),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/benc-uk/go-rest-api/pkg/trace"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+func encodeAttributes(attrs map[string]any) []otlpAttribute {
+	encoded := make([]otlpAttribute, 0, len(attrs))
+
+	for key, value := range attrs {
+		var v map[string]any
+
+		switch val := value.(type) {
+		case string:
+			v = map[string]any{"stringValue": val}
+		case bool:
+			v = map[string]any{"boolValue": val}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(val)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(val, 10)}
+		case float64:
+			v = map[string]any{"doubleValue": val}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(val)}
+		}
+
+		encoded = append(encoded, otlpAttribute{Key: key, Value: v})
+	}
+
+	return encoded
+}
@@ -0,0 +1,189 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2024
+// Licensed under the MIT License.
+//
+// Spans, starting & ending them and handing finished spans to the exporter
+// ----------------------------------------------------------------------------
+
+package trace
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpanKind says what a span represents, the values match OTLP
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = iota + 1
+	SpanKindServer
+	SpanKindClient
+	SpanKindProducer
+	SpanKindConsumer
+)
+
+// StatusCode of a span, the values match OTLP
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = iota
+	StatusOK
+	StatusError
+)
+
+// Exporter sends finished spans somewhere, e.g. an OpenTelemetry collector
+type Exporter interface {
+	// Export is called as each sampled span ends, it must not block
+	Export(span SpanData)
+
+	// Shutdown sends any spans still held and stops the exporter
+	Shutdown(ctx context.Context) error
+}
+
+// SpanData is a finished span, as passed to an Exporter
+type SpanData struct {
+	Name          string
+	Kind          SpanKind
+	SpanContext   SpanContext
+	ParentSpanID  SpanID
+	Start         time.Time
+	End           time.Time
+	Attributes    map[string]any
+	StatusCode    StatusCode
+	StatusMessage string
+}
+
+// Span is a timed operation within a trace, it's safe to use from multiple goroutines
+// Changes made after the span has ended are ignored
+type Span struct {
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+type exporterHolder struct {
+	exporter Exporter
+}
+
+var globalExporter atomic.Pointer[exporterHolder]
+
+// SetExporter sets where finished spans are sent, with no exporter spans are still propagated but not recorded
+func SetExporter(exporter Exporter) {
+	globalExporter.Store(&exporterHolder{exporter: exporter})
+}
+
+// Shutdown flushes & stops the exporter
+func Shutdown(ctx context.Context) error {
+	if holder := globalExporter.Load(); holder != nil && holder.exporter != nil {
+		return holder.exporter.Shutdown(ctx)
+	}
+
+	return nil
+}
+
+// Start begins a new span, a child of the active span in the context, or of a remote parent
+// When there's neither a new trace is started, the span is the active span of the returned context
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanContextFromContext(ctx)
+
+	sc := SpanContext{
+		TraceID: parent.TraceID,
+		SpanID:  newSpanID(),
+		// Root spans are always sampled, otherwise we go with what the caller decided
+		Sampled:    parent.Sampled || !parent.IsValid(),
+		TraceState: parent.TraceState,
+	}
+
+	if !parent.IsValid() {
+		sc.TraceID = newTraceID()
+	}
+
+	span := &Span{
+		data: SpanData{
+			Name:         name,
+			Kind:         kind,
+			SpanContext:  sc,
+			ParentSpanID: parent.SpanID,
+			Start:        time.Now(),
+			Attributes:   map[string]any{},
+		},
+	}
+
+	return ContextWithSpan(ctx, span), span
+}
+
+// SpanContext returns the IDs of the span, to propagate it
+func (s *Span) SpanContext() SpanContext {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.data.SpanContext
+}
+
+// SetName changes the name of the span, e.g. when the route is known after the span started
+func (s *Span) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.ended {
+		s.data.Name = name
+	}
+}
+
+// SetAttribute sets an attribute of the span, values should be strings, bools, ints or floats
+func (s *Span) SetAttribute(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The attributes belong to the exporter once the span has ended
+	if !s.ended {
+		s.data.Attributes[key] = value
+	}
+}
+
+// SetStatus sets the status of the span, the message is only kept for errors
+func (s *Span) SetStatus(code StatusCode, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return
+	}
+
+	s.data.StatusCode = code
+	if code == StatusError {
+		s.data.StatusMessage = message
+	}
+}
+
+// SetError marks the span as failed, a nil error does nothing
+func (s *Span) SetError(err error) {
+	if err != nil {
+		s.SetStatus(StatusError, err.Error())
+	}
+}
+
+// End finishes the span and hands it to the exporter if it's sampled, calls after the first are ignored
+func (s *Span) End() {
+	s.mu.Lock()
+
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	holder := globalExporter.Load()
+	if holder == nil || holder.exporter == nil || !data.SpanContext.Sampled {
+		return
+	}
+
+	holder.exporter.Export(data)
+}